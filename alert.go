@@ -0,0 +1,415 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// AlertState is the state of an alerting rule.
+type AlertState int
+
+const (
+	// AlertInactive rules have not met their condition.
+	AlertInactive AlertState = iota
+	// AlertPending rules have met their condition, but not for long enough
+	// to fire.
+	AlertPending
+	// AlertFiring rules have met their condition for long enough.
+	AlertFiring
+	// AlertResolved rules were firing, but no longer meet their condition.
+	// They otherwise behave like AlertInactive rules.
+	AlertResolved
+)
+
+func (s AlertState) String() string {
+	switch s {
+	case AlertInactive:
+		return "inactive"
+	case AlertPending:
+		return "pending"
+	case AlertFiring:
+		return "firing"
+	case AlertResolved:
+		return "resolved"
+	}
+	return fmt.Sprintf("AlertState(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s AlertState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Alert describes the state of an alerting rule.
+type Alert struct {
+	Name  string     `json:"name"`
+	Rule  string     `json:"rule"`
+	State AlertState `json:"state"`
+	// Value is the value of the rule's expression in the latest interval.
+	Value float64 `json:"value"`
+	// Since is the time of the interval in which the rule entered State.
+	Since time.Time `json:"since"`
+	// Time is the time of the latest interval.
+	Time time.Time `json:"time"`
+}
+
+// Notifier is notified when an alerting rule starts firing and when it is
+// resolved.  Notify is called from the goroutine processing an interval,
+// so it should not block for long.
+type Notifier interface {
+	Notify(alert Alert)
+}
+
+// NotifierFunc adapts a function to a Notifier.
+type NotifierFunc func(alert Alert)
+
+// Notify implements Notifier.
+func (f NotifierFunc) Notify(alert Alert) {
+	f(alert)
+}
+
+// LogNotifier logs alerts with glog, firing ones as errors and resolved
+// ones as info.
+type LogNotifier struct{}
+
+// Notify implements Notifier.
+func (LogNotifier) Notify(alert Alert) {
+	if alert.State == AlertFiring {
+		glog.Errorf("alert %s is firing: %s (value %g)", alert.Name, alert.Rule,
+			alert.Value)
+		return
+	}
+	glog.Infof("alert %s is %s: %s (value %g)", alert.Name, alert.State,
+		alert.Rule, alert.Value)
+}
+
+// WebhookNotifier POSTs each alert as JSON to URL.  Requests are made in
+// the background, and failures are logged.
+type WebhookNotifier struct {
+	URL string
+	// Client is used to make requests, or a client with a 10 second timeout
+	// if nil.
+	Client *http.Client
+}
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Notify implements Notifier.
+func (w *WebhookNotifier) Notify(alert Alert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		glog.Errorf("unable to encode alert %s: %s", alert.Name, err)
+		return
+	}
+	client := w.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	go func() {
+		resp, err := client.Post(w.URL, "application/json",
+			bytes.NewReader(body))
+		if err != nil {
+			glog.Errorf("unable to notify %s of alert %s: %s", w.URL, alert.Name,
+				err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			glog.Errorf("unable to notify %s of alert %s: %s", w.URL, alert.Name,
+				resp.Status)
+		}
+	}()
+}
+
+// alertRule is a parsed alerting rule and its state.
+type alertRule struct {
+	name      string
+	rule      string
+	expr      exprNode
+	op        string
+	threshold float64
+	// forIntervals is the number of consecutive intervals in which the
+	// condition must hold before the rule fires.  forDuration is the hold
+	// as parsed, if given as a duration, which AddAlert converts to
+	// forIntervals.
+	forIntervals int
+	forDuration  time.Duration
+
+	state AlertState
+	since time.Time
+	value float64
+	// held is the number of consecutive intervals meeting the condition.
+	held int
+}
+
+// parseAlertRule parses a rule of the form
+//
+//	<expr> <comparison> <threshold> [for <n> intervals | for <duration>]
+func parseAlertRule(name, rule string) (*alertRule, error) {
+	tokens, err := tokenize(rule)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	comparison := p.peek()
+	if comparison.kind != 'c' {
+		return nil, fmt.Errorf("expected a comparison, found %s", comparison)
+	}
+	p.pos++
+	a := &alertRule{name: name, rule: rule, expr: expr, op: comparison.text}
+
+	negative := p.peek().kind == '-'
+	if negative {
+		p.pos++
+	}
+	threshold, unit, err := p.quantity()
+	if err != nil {
+		return nil, err
+	}
+	if unit == "" {
+		if a.threshold, err = strconv.ParseFloat(threshold, 64); err != nil {
+			return nil, fmt.Errorf("invalid threshold %q", threshold)
+		}
+	} else {
+		// durations are compared in nanoseconds, as recorded by timers
+		duration, err := time.ParseDuration(threshold + unit)
+		if err != nil {
+			return nil, err
+		}
+		a.threshold = float64(duration)
+	}
+	if negative {
+		a.threshold = -a.threshold
+	}
+
+	if token := p.peek(); token.kind == 'i' && token.text == "for" {
+		p.pos++
+		amount, unit, err := p.quantity()
+		if err != nil {
+			return nil, err
+		}
+		if unit == "interval" || unit == "intervals" {
+			if a.forIntervals, err = strconv.Atoi(amount); err != nil {
+				return nil, fmt.Errorf("invalid number of intervals %q", amount)
+			}
+		} else if a.forDuration, err = time.ParseDuration(amount +
+			unit); err != nil {
+			return nil, err
+		}
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s after rule", p.peek())
+	}
+	return a, nil
+}
+
+// quantity consumes a number and the unit following it, if any.
+func (p *exprParser) quantity() (number, unit string, err error) {
+	// a unit written without a space, as in 250ms, is lexed as one name
+	if token := p.peek(); token.kind == 'i' {
+		runes := []rune(token.text)
+		if length := numberLength(runes); length > 0 {
+			p.pos++
+			return string(runes[:length]), string(runes[length:]), nil
+		}
+	}
+	token, err := p.expect('n')
+	if err != nil {
+		return "", "", err
+	}
+	if next := p.peek(); next.kind == 'i' && next.text != "for" {
+		p.pos++
+		unit = next.text
+	}
+	return token.text, unit, nil
+}
+
+// holds returns whether value meets the condition of the rule.
+func (a *alertRule) holds(value float64) bool {
+	switch a.op {
+	case ">":
+		return value > a.threshold
+	case ">=":
+		return value >= a.threshold
+	case "<":
+		return value < a.threshold
+	case "<=":
+		return value <= a.threshold
+	case "==":
+		return value == a.threshold
+	}
+	return value != a.threshold
+}
+
+// alert returns the current state of the rule.
+func (a *alertRule) alert(now time.Time) Alert {
+	return Alert{
+		Name:  a.name,
+		Rule:  a.rule,
+		State: a.state,
+		Value: a.value,
+		Since: a.since,
+		Time:  now,
+	}
+}
+
+// AddAlert adds an alerting rule evaluated on each processed interval, such
+// as
+//
+//	rpc_latency_99 > 250ms for 3 intervals
+//	requests_rate == 0 for 5m
+//
+// The left side is an expression as accepted by RegisterDerived, and may
+// be compared with <, <=, >, >=, == or != to a number or, for timers, a
+// duration.  The optional hold is the number of consecutive intervals in
+// which the condition must be met before the rule fires, and the rule is
+// pending until then.  A hold given as a duration is rounded up to a whole
+// number of intervals, each of which covers one interval of time, so
+// "for 5m" with a 1m interval fires on the 5th consecutive interval, like
+// "for 5 intervals".  Without a hold, the rule fires on the first interval
+// meeting the condition.  An interval missing a metric of the expression
+// does not meet the condition, though counters that were not incremented
+// in an interval are treated as having a _rate of 0.  Notifiers are
+// notified when the rule fires and when it is resolved.  Adding a rule
+// under an existing name replaces it.
+func (ms *MetricSystem) AddAlert(name, rule string) error {
+	a, err := parseAlertRule(name, rule)
+	if err != nil {
+		return fmt.Errorf("unable to parse alerting rule %s: %s", name, err)
+	}
+	if a.forDuration > 0 {
+		a.forIntervals = ms.windowIntervals(a.forDuration)
+	}
+	ms.alertsMu.Lock()
+	defer ms.alertsMu.Unlock()
+	for i, existing := range ms.alerts {
+		if existing.name == name {
+			ms.alerts[i] = a
+			return nil
+		}
+	}
+	ms.alerts = append(ms.alerts, a)
+	return nil
+}
+
+// RemoveAlert removes an alerting rule, without notifying its resolution.
+func (ms *MetricSystem) RemoveAlert(name string) {
+	ms.alertsMu.Lock()
+	defer ms.alertsMu.Unlock()
+	for i, existing := range ms.alerts {
+		if existing.name == name {
+			ms.alerts = append(ms.alerts[:i], ms.alerts[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddNotifier adds a Notifier of alerts.
+func (ms *MetricSystem) AddNotifier(notifier Notifier) {
+	ms.alertsMu.Lock()
+	defer ms.alertsMu.Unlock()
+	ms.notifiers = append(ms.notifiers, notifier)
+}
+
+// Alerts returns the state of every alerting rule, sorted by name.
+func (ms *MetricSystem) Alerts() []Alert {
+	ms.alertsMu.Lock()
+	defer ms.alertsMu.Unlock()
+	alerts := make([]Alert, 0, len(ms.alerts))
+	for _, a := range ms.alerts {
+		alerts = append(alerts, a.alert(ms.lastAlertTime))
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].Name < alerts[j].Name
+	})
+	return alerts
+}
+
+// evaluateAlerts advances every alerting rule by a processed interval.
+// Intervals are processed concurrently, so any interval older than the
+// latest one evaluated is skipped.  Notifiers are called in the goroutine
+// processing the interval.
+func (ms *MetricSystem) evaluateAlerts(rawMetrics *RawMetricSet,
+	processedMetrics *ProcessedMetricSet) {
+	ms.alertsMu.Lock()
+	now := processedMetrics.Time
+	if len(ms.alerts) == 0 || now.Before(ms.lastAlertTime) {
+		ms.alertsMu.Unlock()
+		return
+	}
+	ms.lastAlertTime = now
+
+	ctx := &exprContext{
+		ms:         ms,
+		rawMetrics: rawMetrics,
+		metrics:    processedMetrics.Metrics,
+		idleRates:  true,
+	}
+	var notifications []Alert
+	for _, a := range ms.alerts {
+		value, present := a.expr.eval(ctx)
+		a.value = value
+		previous := a.state
+		if !present || !a.holds(value) {
+			a.held = 0
+			switch a.state {
+			case AlertFiring:
+				a.state = AlertResolved
+			case AlertPending:
+				a.state = AlertInactive
+			}
+		} else {
+			a.held++
+			if a.state != AlertPending && a.state != AlertFiring {
+				a.state = AlertPending
+				a.since = now
+			}
+			if a.state == AlertPending && a.held >= a.forIntervals {
+				a.state = AlertFiring
+			}
+		}
+		if a.state != previous {
+			a.since = now
+			if a.state == AlertFiring || a.state == AlertResolved {
+				notifications = append(notifications, a.alert(now))
+			}
+		}
+	}
+	notifiers := ms.notifiers
+	ms.alertsMu.Unlock()
+
+	// notifiers may inspect the MetricSystem, so they are called unlocked
+	for _, alert := range notifications {
+		for _, notifier := range notifiers {
+			notifier.Notify(alert)
+		}
+	}
+}
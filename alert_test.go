@@ -0,0 +1,214 @@
+package loghisto
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// evaluateInterval processes the metrics recorded since the last interval
+// as the interval of t, and evaluates alerts on them.
+func evaluateInterval(ms *MetricSystem, t time.Time) {
+	raw := ms.collectRawMetrics()
+	processed := ms.processMetrics(raw)
+	processed.Time = t
+	ms.evaluateAlerts(raw, processed)
+}
+
+func TestAlertIntervals(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	err := metricSystem.AddAlert("slow", "latency_99 > 250ms for 3 intervals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notifications []Alert
+	metricSystem.AddNotifier(NotifierFunc(func(alert Alert) {
+		notifications = append(notifications, alert)
+	}))
+
+	start := time.Unix(1000, 0)
+	expected := []AlertState{AlertPending, AlertPending, AlertFiring,
+		AlertFiring, AlertResolved}
+	for i, state := range expected {
+		latency := 300 * time.Millisecond
+		if i == len(expected)-1 {
+			latency = 100 * time.Millisecond
+		}
+		metricSystem.Histogram("latency", float64(latency))
+		evaluateInterval(metricSystem, start.Add(time.Duration(i)*time.Second))
+		alerts := metricSystem.Alerts()
+		if len(alerts) != 1 || alerts[0].State != state {
+			t.Fatalf("expected the alert to be %s after interval %d, got %v",
+				state, i, alerts)
+		}
+	}
+
+	if len(notifications) != 2 {
+		t.Fatalf("expected 2 notifications, got %v", notifications)
+	}
+	if notifications[0].State != AlertFiring ||
+		!notifications[0].Since.Equal(start.Add(2*time.Second)) ||
+		notifications[0].Value < float64(250*time.Millisecond) {
+		t.Errorf("unexpected firing notification %v", notifications[0])
+	}
+	if notifications[1].State != AlertResolved ||
+		!notifications[1].Since.Equal(start.Add(4*time.Second)) {
+		t.Errorf("unexpected resolved notification %v", notifications[1])
+	}
+
+	// a pending alert becomes inactive without notifying anyone
+	metricSystem.Histogram("latency", float64(time.Second))
+	evaluateInterval(metricSystem, start.Add(5*time.Second))
+	evaluateInterval(metricSystem, start.Add(6*time.Second))
+	if state := metricSystem.Alerts()[0].State; state != AlertInactive {
+		t.Errorf("expected the alert to be inactive, got %s", state)
+	}
+	if len(notifications) != 2 {
+		t.Errorf("expected no more notifications, got %v", notifications)
+	}
+}
+
+func TestAlertIdleCounter(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Minute, false)
+	err := metricSystem.AddAlert("idle", "requests_rate == 0 for 5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fired := 0
+	metricSystem.AddNotifier(NotifierFunc(func(alert Alert) {
+		if alert.State == AlertFiring {
+			fired++
+		}
+	}))
+
+	start := time.Unix(1000, 0)
+	metricSystem.Counter("requests", 1)
+	evaluateInterval(metricSystem, start)
+	if state := metricSystem.Alerts()[0].State; state != AlertInactive {
+		t.Fatalf("expected the alert to be inactive with traffic, got %s",
+			state)
+	}
+
+	// the counter goes idle, and a duration holds for as many intervals
+	for i := 1; i <= 5; i++ {
+		evaluateInterval(metricSystem, start.Add(time.Duration(i)*time.Minute))
+		state := metricSystem.Alerts()[0].State
+		if i < 5 && state != AlertPending {
+			t.Fatalf("expected the alert to be pending after %d idle "+
+				"intervals, got %s", i, state)
+		}
+	}
+	if fired != 1 {
+		t.Errorf("expected the alert to fire after 5 idle intervals, fired "+
+			"%d times", fired)
+	}
+
+	// processing itself reports no rate for idle counters
+	idle := metricSystem.processMetrics(metricSystem.collectRawMetrics())
+	if _, present := idle.Metrics["requests_rate"]; present {
+		t.Error("expected no requests_rate in an idle interval")
+	}
+
+	// older intervals processed late are skipped
+	metricSystem.Counter("requests", 5)
+	evaluateInterval(metricSystem, start)
+	if state := metricSystem.Alerts()[0].State; state != AlertFiring {
+		t.Errorf("expected an out of order interval to be skipped, got %s",
+			state)
+	}
+}
+
+func TestAlertHoldsAgree(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Minute, false)
+	for name, rule := range map[string]string{
+		"intervals":  "x > 0 for 2 intervals",
+		"duration":   "x > 0 for 2m",
+		"rounded up": "x > 0 for 90s",
+	} {
+		if err := metricSystem.AddAlert(name, rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Unix(1000, 0)
+	for i := 0; i < 2; i++ {
+		metricSystem.Counter("x", 1)
+		evaluateInterval(metricSystem, start.Add(time.Duration(i)*time.Minute))
+		expected := []AlertState{AlertPending, AlertFiring}[i]
+		for _, alert := range metricSystem.Alerts() {
+			if alert.State != expected {
+				t.Errorf("expected %s to be %s after %d intervals, got %s",
+					alert.Name, expected, i+1, alert.State)
+			}
+		}
+	}
+}
+
+func TestParseAlertRule(t *testing.T) {
+	a, err := parseAlertRule("a", "x >= -2.5 for 3 intervals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.op != ">=" || a.threshold != -2.5 || a.forIntervals != 3 {
+		t.Errorf("unexpected rule %+v", a)
+	}
+	a, err = parseAlertRule("a", "percentile(x, 0.5) != 1h30m for 1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.op != "!=" || a.threshold != float64(90*time.Minute) ||
+		a.forDuration != time.Minute {
+		t.Errorf("unexpected rule %+v", a)
+	}
+	a, err = parseAlertRule("a", "5xx_rate > 250ms for 3intervals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.expr != metricNode("5xx_rate") ||
+		a.threshold != float64(250*time.Millisecond) || a.forIntervals != 3 {
+		t.Errorf("unexpected rule %+v", a)
+	}
+
+	for _, rule := range []string{
+		"x",
+		"x >",
+		"x = 1",
+		"x > 1 for",
+		"x > 1 for 3 lightyears",
+		"x > 1 y",
+		"x > 2 for 1.5 intervals",
+	} {
+		if _, err := parseAlertRule("a", rule); err == nil {
+			t.Errorf("expected an error parsing %q", rule)
+		}
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			var alert map[string]interface{}
+			if err := json.Unmarshal(body, &alert); err != nil {
+				t.Error(err)
+			}
+			received <- alert
+		}))
+	defer server.Close()
+
+	notifier := &WebhookNotifier{URL: server.URL}
+	notifier.Notify(Alert{Name: "slow", Rule: "x > 1", State: AlertFiring,
+		Value: 2})
+	select {
+	case alert := <-received:
+		if alert["name"] != "slow" || alert["state"] != "firing" ||
+			alert["value"] != float64(2) {
+			t.Errorf("unexpected webhook body %v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the webhook to be called")
+	}
+}
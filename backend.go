@@ -0,0 +1,339 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// HistogramBackend is a data structure that summarizes the values recorded
+// under a histogram name during an interval.  Implementations need not be
+// safe for concurrent use, as MetricSystem serializes calls to Record, but
+// Merge must not modify its argument, and Quantiles, Count, Sum and Encode
+// must not modify their receiver, as completed intervals may be read by
+// several consumers at once.
+type HistogramBackend interface {
+	// Record adds a value to the histogram.
+	Record(value float64)
+	// Merge adds all values summarized by other, which must be of the same
+	// type and configuration, to the histogram.
+	Merge(other HistogramBackend) error
+	// Quantiles estimates the values at each quantile of qs, each between
+	// 0 and 1 inclusive.
+	Quantiles(qs []float64) []float64
+	// Count returns the number of values recorded.
+	Count() uint64
+	// Sum returns the sum of values recorded.
+	Sum() float64
+	// Encode returns a compact binary representation of the histogram.
+	Encode() []byte
+}
+
+// BucketHistogram is the default HistogramBackend, which counts values in
+// the buckets of a BucketMapping.  MetricSystem stores these counts
+// directly in RawMetricSet.Histograms for speed, so using a
+// BucketHistogram as the backend of a histogram is equivalent to
+// specifying its mapping.
+type BucketHistogram struct {
+	mapping BucketMapping
+	counts  map[int32]uint64
+	count   uint64
+	sum     float64
+}
+
+// NewBucketHistogram creates an empty BucketHistogram with a mapping.
+func NewBucketHistogram(mapping BucketMapping) *BucketHistogram {
+	return &BucketHistogram{
+		mapping: mapping,
+		counts:  make(map[int32]uint64),
+	}
+}
+
+// NewHDRHistogram creates an empty BucketHistogram whose buckets keep
+// significantDigits significant decimal digits of each value, in the style
+// of HdrHistogram.
+func NewHDRHistogram(significantDigits int) *BucketHistogram {
+	return NewBucketHistogram(NewHDRMapping(significantDigits))
+}
+
+// Mapping returns the BucketMapping of the histogram.
+func (h *BucketHistogram) Mapping() BucketMapping {
+	return h.mapping
+}
+
+// Record implements HistogramBackend.
+func (h *BucketHistogram) Record(value float64) {
+	h.counts[h.mapping.Key(value)]++
+	h.count++
+	h.sum += value
+}
+
+// Merge implements HistogramBackend.
+func (h *BucketHistogram) Merge(other HistogramBackend) error {
+	o, ok := other.(*BucketHistogram)
+	if !ok {
+		return fmt.Errorf("cannot merge %T into a BucketHistogram", other)
+	}
+	if o.mapping != h.mapping {
+		return fmt.Errorf("cannot merge histograms with mappings %s and %s",
+			o.mapping, h.mapping)
+	}
+	for key, count := range o.counts {
+		h.counts[key] += count
+	}
+	h.count += o.count
+	h.sum += o.sum
+	return nil
+}
+
+// Quantiles implements HistogramBackend, interpolating within the value
+// range of each quantile's bucket.
+func (h *BucketHistogram) Quantiles(qs []float64) []float64 {
+	proportions := make([]proportion, 0, len(h.counts))
+	for key, count := range h.counts {
+		proportions = append(proportions, proportion{
+			Value: h.mapping.Value(key),
+			Count: count,
+			Key:   key,
+		})
+	}
+	values := make([]float64, len(qs))
+	buckets, err := percentiles(h.count, proportions, qs)
+	if err != nil {
+		for i := range values {
+			values[i] = math.NaN()
+		}
+		return values
+	}
+	for i, bucket := range buckets {
+		values[i] = bucket.interpolate(qs[i], h.count, h.mapping)
+	}
+	return values
+}
+
+// Count implements HistogramBackend.
+func (h *BucketHistogram) Count() uint64 {
+	return h.count
+}
+
+// Sum implements HistogramBackend.
+func (h *BucketHistogram) Sum() float64 {
+	return h.sum
+}
+
+// Encode implements HistogramBackend.  The encoding is the sum as 8 bytes,
+// followed by a varint bucket key and uvarint count for each bucket in
+// ascending key order.
+func (h *BucketHistogram) Encode() []byte {
+	keys := make([]int, 0, len(h.counts))
+	for key := range h.counts {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+
+	buf := make([]byte, 8, 8+len(keys)*2*binary.MaxVarintLen32)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(h.sum))
+	scratch := make([]byte, binary.MaxVarintLen64)
+	for _, key := range keys {
+		n := binary.PutVarint(scratch, int64(key))
+		buf = append(buf, scratch[:n]...)
+		n = binary.PutUvarint(scratch, h.counts[int32(key)])
+		buf = append(buf, scratch[:n]...)
+	}
+	return buf
+}
+
+// DecodeBucketHistogram reverses BucketHistogram.Encode, given the mapping
+// of the encoded histogram.
+func DecodeBucketHistogram(data []byte,
+	mapping BucketMapping) (*BucketHistogram, error) {
+	if len(data) < 8 {
+		return nil, errors.New("encoded BucketHistogram is too short")
+	}
+	h := NewBucketHistogram(mapping)
+	h.sum = math.Float64frombits(binary.BigEndian.Uint64(data))
+	data = data[8:]
+	for len(data) > 0 {
+		key, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid bucket key in BucketHistogram")
+		}
+		data = data[n:]
+		count, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid bucket count in BucketHistogram")
+		}
+		data = data[n:]
+		h.counts[int32(key)] += count
+		h.count += count
+	}
+	return h, nil
+}
+
+// HDRMapping is a BucketMapping in the style of HdrHistogram, which keeps a
+// fixed number of significant decimal digits.  Magnitudes below
+// 2 * 10^SignificantDigits are counted in unit-width buckets, and every
+// following power of 2 is split into at least 10^SignificantDigits linear
+// sub-buckets, so the relative error never exceeds
+// 1 / (2 * 10^SignificantDigits) once a value is at least 1.  Magnitudes
+// below 1 are counted as 0, so values should be recorded in the smallest
+// unit of interest, such as nanoseconds.
+type HDRMapping struct {
+	significantDigits int
+	// subBucketBits is the log2 of the number of sub-buckets per power of 2
+	// once past the linear region.
+	subBucketBits uint
+}
+
+// NewHDRMapping creates an HDRMapping keeping significantDigits digits,
+// which should be between 1 and 5.
+func NewHDRMapping(significantDigits int) HDRMapping {
+	subBucketBits := uint(math.Ceil(math.Log2(
+		2 * math.Pow10(significantDigits))))
+	return HDRMapping{
+		significantDigits: significantDigits,
+		subBucketBits:     subBucketBits,
+	}
+}
+
+// Key implements BucketMapping.
+func (m HDRMapping) Key(value float64) int32 {
+	magnitude := math.Floor(math.Abs(value))
+	subBucketCount := float64(uint64(1) << m.subBucketBits)
+	var key float64
+	switch {
+	case math.IsNaN(magnitude):
+		return 0
+	case magnitude < subBucketCount:
+		key = magnitude
+	default:
+		halfCount := subBucketCount / 2
+		_, exp := math.Frexp(magnitude)
+		// exp is such that 2^(exp-1) <= magnitude < 2^exp
+		shift := exp - int(m.subBucketBits)
+		subBucket := math.Floor(math.Ldexp(magnitude, -shift))
+		key = subBucketCount + float64(shift-1)*halfCount +
+			(subBucket - halfCount)
+		if key > math.MaxInt32 || math.IsInf(magnitude, 0) {
+			key = math.MaxInt32
+		}
+	}
+	if value < 0 {
+		return -int32(key)
+	}
+	return int32(key)
+}
+
+// Value implements BucketMapping.
+func (m HDRMapping) Value(key int32) float64 {
+	lower, upper := m.Bounds(key)
+	if upper-lower == 1 {
+		// unit-width buckets hold a single integer magnitude exactly
+		if key < 0 {
+			return upper
+		}
+		return lower
+	}
+	return (lower + upper) / 2
+}
+
+// Bounds implements BucketMapping.
+func (m HDRMapping) Bounds(key int32) (lower, upper float64) {
+	k := math.Abs(float64(key))
+	subBucketCount := float64(uint64(1) << m.subBucketBits)
+	if k < subBucketCount {
+		lower, upper = k, k+1
+	} else {
+		halfCount := subBucketCount / 2
+		shift := math.Floor((k-subBucketCount)/halfCount) + 1
+		subBucket := k - subBucketCount - (shift-1)*halfCount + halfCount
+		lower = math.Ldexp(subBucket, int(shift))
+		upper = math.Ldexp(subBucket+1, int(shift))
+	}
+	if key == 0 {
+		// magnitudes below 1 of either sign are counted as 0
+		return -upper, upper
+	}
+	if key < 0 {
+		return -upper, -lower
+	}
+	return lower, upper
+}
+
+// RelativeError implements BucketMapping.  The bound holds for all values
+// whose magnitude is an integer of at least 1.
+func (m HDRMapping) RelativeError() float64 {
+	return 1 / (2 * math.Pow10(m.significantDigits))
+}
+
+// MaxValue implements BucketMapping.
+func (m HDRMapping) MaxValue() float64 {
+	return m.Value(math.MaxInt32)
+}
+
+func (m HDRMapping) String() string {
+	return fmt.Sprintf("hdr(digits=%d, relative error=%.3g%%, max=%g)",
+		m.significantDigits, 100*m.RelativeError(), m.MaxValue())
+}
+
+// SpecifyHistogramBackend selects the HistogramBackend used for the named
+// histogram, which should be done before any values are recorded under
+// that name.  newBackend is called to create an empty backend for each
+// interval.  Backends that return a *BucketHistogram keep using the fast
+// path of RawMetricSet.Histograms with the BucketHistogram's mapping;
+// others are exported through RawMetricSet.Backends.
+func (ms *MetricSystem) SpecifyHistogramBackend(name string,
+	newBackend func() HistogramBackend) {
+	bucketHistogram, bucketed := newBackend().(*BucketHistogram)
+	ms.updateHistogramSettings(func(settings *histogramSettings) {
+		if bucketed {
+			delete(settings.backends, name)
+			settings.mappings[name] = bucketHistogram.Mapping()
+		} else {
+			settings.backends[name] = newBackend
+		}
+	})
+}
+
+// newHistogramBackend creates an empty backend for a histogram that uses a
+// custom HistogramBackend, returning nil for other histograms.
+func (ms *MetricSystem) newHistogramBackend(name string) HistogramBackend {
+	newBackend, present := ms.loadHistogramSettings().backends[name]
+	if !present {
+		return nil
+	}
+	return newBackend()
+}
+
+// recordBackend records a value into the current interval's backend for a
+// histogram that uses a custom HistogramBackend.
+func (ms *MetricSystem) recordBackend(name string, value float64,
+	newBackend func() HistogramBackend) {
+	ms.backendMu.Lock()
+	backend, present := ms.backendCache[name]
+	if !present {
+		backend = newBackend()
+		ms.backendCache[name] = backend
+	}
+	backend.Record(value)
+	ms.backendMu.Unlock()
+}
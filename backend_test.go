@@ -0,0 +1,115 @@
+package loghisto
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBucketHistogram(t *testing.T) {
+	h := NewBucketHistogram(DefaultMapping)
+	other := NewBucketHistogram(DefaultMapping)
+	for i := 1; i <= 100; i++ {
+		h.Record(float64(i))
+		other.Record(float64(i + 100))
+	}
+	if err := h.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	if h.Count() != 200 || h.Sum() != 20100 {
+		t.Errorf("expected count 200 and sum 20100, got %d and %f", h.Count(),
+			h.Sum())
+	}
+	quantiles := h.Quantiles([]float64{.5, 1})
+	if math.Abs(quantiles[0]/100-1) > .01 || math.Abs(quantiles[1]/200-1) > .01 {
+		t.Errorf("expected quantiles near 100 and 200, got %v", quantiles)
+	}
+
+	if err := h.Merge(NewHDRHistogram(3)); err == nil {
+		t.Error("expected an error merging histograms with different mappings")
+	}
+	if err := h.Merge(NewTDigest(100)); err == nil {
+		t.Error("expected an error merging a TDigest into a BucketHistogram")
+	}
+
+	decoded, err := DecodeBucketHistogram(h.Encode(), DefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Count() != h.Count() || decoded.Sum() != h.Sum() ||
+		len(decoded.counts) != len(h.counts) {
+		t.Errorf("decoded histogram differs: %+v", decoded)
+	}
+	if _, err := DecodeBucketHistogram([]byte{1}, DefaultMapping); err == nil {
+		t.Error("expected an error decoding a truncated histogram")
+	}
+}
+
+func TestHDRMapping(t *testing.T) {
+	for digits := 1; digits <= 4; digits++ {
+		mapping := NewHDRMapping(digits)
+		previous := int32(-1)
+		for _, f := range []float64{
+			1, 2, 199, 2047, 2048, 2049, 4095, 4096, 123456, 1e9, 1e15, 1e300,
+		} {
+			key := mapping.Key(f)
+			if key < previous {
+				t.Errorf("%s: keys must not decrease, %g had key %d after %d",
+					mapping, f, key, previous)
+			}
+			previous = key
+			result := mapping.Value(key)
+			if diff := math.Abs(result/f - 1); diff > mapping.RelativeError() {
+				t.Errorf("%s: expected: %g, actual: %g, %% off: %.04f",
+					mapping, f, result, diff*100)
+			}
+			if negative := mapping.Value(mapping.Key(-f)); negative != -result {
+				t.Errorf("%s: expected %g, got %g", mapping, -result, negative)
+			}
+		}
+	}
+	if NewHDRMapping(3).Key(0.5) != 0 {
+		t.Error("expected magnitudes below 1 to be counted as 0")
+	}
+}
+
+func TestSpecifyHistogramBackend(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyHistogramBackend("digest", func() HistogramBackend {
+		return NewTDigest(100)
+	})
+	metricSystem.SpecifyHistogramBackend("hdr", func() HistogramBackend {
+		return NewHDRHistogram(2)
+	})
+	for i := 1; i <= 1000; i++ {
+		metricSystem.Histogram("digest", float64(i))
+		metricSystem.Histogram("hdr", float64(i))
+	}
+	rawMetrics := metricSystem.collectRawMetrics()
+
+	if _, present := rawMetrics.Backends["digest"]; !present {
+		t.Error("expected digest to be exported through Backends")
+	}
+	if _, present := rawMetrics.Histograms["hdr"]; !present {
+		t.Error("expected hdr to use the bucket fast path")
+	}
+	if rawMetrics.Mapping("hdr") != NewHDRMapping(2) {
+		t.Errorf("expected hdr to use an HDRMapping, got %s",
+			rawMetrics.Mapping("hdr"))
+	}
+
+	metrics := metricSystem.processMetrics(rawMetrics).Metrics
+	for _, name := range []string{"digest", "hdr"} {
+		if metrics[name+"_count"] != 1000 {
+			t.Errorf("expected %s_count of 1000, got %f", name,
+				metrics[name+"_count"])
+		}
+		if diff := math.Abs(metrics[name+"_99"]/990 - 1); diff > .01 {
+			t.Errorf("expected %s_99 within 1%% of 990, got %f", name,
+				metrics[name+"_99"])
+		}
+	}
+	if metrics["digest_sum"] != 500500 {
+		t.Errorf("expected digest_sum of 500500, got %f", metrics["digest_sum"])
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"time"
+)
+
+// Clock is the source of time used by a MetricSystem for interval
+// boundaries, timestamps and timer durations.  The default is the wall
+// clock; a fake implementation lives in the clocktest subpackage.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel that receives the current time once the
+	// duration d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is a Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// timeUntilNextInterval returns the duration from now until the next
+// multiple of interval since the Unix epoch.
+func timeUntilNextInterval(now time.Time, interval time.Duration) time.Duration {
+	return time.Duration(interval.Nanoseconds() -
+		(now.UnixNano() % interval.Nanoseconds()))
+}
+
+// normalizeToInterval truncates t down to a multiple of interval since the
+// Unix epoch.
+func normalizeToInterval(t time.Time, interval time.Duration) time.Time {
+	return time.Unix(0, t.UnixNano()/
+		interval.Nanoseconds()*
+		interval.Nanoseconds())
+}
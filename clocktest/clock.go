@@ -0,0 +1,107 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+// Package clocktest provides a manually driven implementation of
+// loghisto.Clock for deterministic tests of interval handling.
+package clocktest
+
+import (
+	"sync"
+	"time"
+)
+
+// waiter is a pending channel returned by After.
+type waiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// Clock is a fake clock whose time only moves when Advance or Set is
+// called.  It is safe for concurrent use.
+type Clock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []waiter
+}
+
+// NewClock returns a Clock set to the provided time.
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current fake time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the fake time once the clock has
+// been advanced by at least d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{deadline: c.now.Add(d), c: ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the clock forward by d, firing any expired After channels.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.setLocked(c.now.Add(d))
+	c.mu.Unlock()
+}
+
+// Set moves the clock to t, firing any expired After channels.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	c.setLocked(t)
+	c.mu.Unlock()
+}
+
+func (c *Clock) setLocked(t time.Time) {
+	c.now = t
+	remaining := c.waiters[:0]
+	for _, w := range c.waiters {
+		if !w.deadline.After(t) {
+			w.c <- t
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	c.waiters = remaining
+}
+
+// BlockUntil blocks until at least n goroutines are waiting on channels
+// returned by After.  This lets a test wait for a reaper to go to sleep
+// before advancing the clock past an interval boundary.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
@@ -0,0 +1,51 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdvance(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewClock(start)
+	ch := c.After(time.Second)
+
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Error("After fired before its deadline")
+	default:
+	}
+
+	c.Advance(time.Millisecond)
+	select {
+	case fired := <-ch:
+		if !fired.Equal(start.Add(time.Second)) {
+			t.Errorf("expected %s, got %s", start.Add(time.Second), fired)
+		}
+	default:
+		t.Error("After did not fire at its deadline")
+	}
+
+	if !c.Now().Equal(start.Add(time.Second)) {
+		t.Errorf("expected %s, got %s", start.Add(time.Second), c.Now())
+	}
+}
+
+func TestBlockUntil(t *testing.T) {
+	c := NewClock(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		<-c.After(time.Minute)
+		close(done)
+	}()
+
+	c.BlockUntil(1)
+	c.Set(time.Unix(60, 0))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("waiter was not woken by Set")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// minCumulativeCount is the weight below which a bucket of a decaying
+// cumulative histogram is forgotten.
+const minCumulativeCount = 1e-3
+
+// cumulativeHistogram holds the bucket counts of a histogram across
+// intervals.
+type cumulativeHistogram struct {
+	// decay is the factor applied to the counts at each interval, which is
+	// 1 for histograms that never forget.
+	decay  float64
+	counts map[int32]float64
+}
+
+// cumulativeSnapshot is the state of a cumulative histogram at the end of
+// an interval.
+type cumulativeSnapshot struct {
+	mapping BucketMapping
+	counts  map[int32]float64
+}
+
+// SpecifyCumulativePercentiles keeps the bucket counts of the named
+// histogram across intervals, and exports the percentiles of all values
+// seen so far as <name>_agg_<percentile>, such as latency_agg_99, at every
+// interval, even those in which no values were recorded.  This gives
+// meaningful tail percentiles for histograms that see few values per
+// interval.  If halfLife is positive, the weight of each value halves every
+// halfLife, so the percentiles follow recent values; otherwise values are
+// kept forever.  Only histograms that use a BucketMapping are supported.
+func (ms *MetricSystem) SpecifyCumulativePercentiles(name string,
+	halfLife time.Duration) {
+	decay := float64(1)
+	if halfLife > 0 {
+		decay = math.Pow(.5, ms.interval.Seconds()/halfLife.Seconds())
+	}
+	ms.cumulativeMu.Lock()
+	ms.cumulative[name] = &cumulativeHistogram{
+		decay:  decay,
+		counts: make(map[int32]float64),
+	}
+	ms.cumulativeMu.Unlock()
+}
+
+// accumulate adds the histograms collected in an interval to their
+// cumulative histograms, and returns a snapshot of every cumulative
+// histogram.
+func (ms *MetricSystem) accumulate(
+	histograms map[string]map[int32]*uint64) map[string]cumulativeSnapshot {
+	ms.cumulativeMu.Lock()
+	defer ms.cumulativeMu.Unlock()
+	if len(ms.cumulative) == 0 {
+		return nil
+	}
+	settings := ms.loadHistogramSettings()
+	snapshots := make(map[string]cumulativeSnapshot, len(ms.cumulative))
+	for name, c := range ms.cumulative {
+		if c.decay < 1 {
+			for key, count := range c.counts {
+				if count *= c.decay; count < minCumulativeCount {
+					delete(c.counts, key)
+				} else {
+					c.counts[key] = count
+				}
+			}
+		}
+		for key, count := range histograms[name] {
+			c.counts[key] += float64(*count)
+		}
+		counts := make(map[int32]float64, len(c.counts))
+		for key, count := range c.counts {
+			counts[key] = count
+		}
+		snapshots[name] = cumulativeSnapshot{
+			mapping: settings.mapping(name),
+			counts:  counts,
+		}
+	}
+	return snapshots
+}
+
+// processCumulative calculates the <name>_agg_<percentile> outputs of a
+// cumulative histogram.
+func (ms *MetricSystem) processCumulative(name string,
+	snapshot cumulativeSnapshot) map[string]float64 {
+	output := make(map[string]float64)
+	counts, mapping := snapshot.counts, snapshot.mapping
+	keys := make([]int, 0, len(counts))
+	total := float64(0)
+	for key, count := range counts {
+		keys = append(keys, int(key))
+		total += count
+	}
+	if total == 0 {
+		return output
+	}
+	// keys of a BucketMapping are ordered like their values
+	sort.Ints(keys)
+
+	labels, ps := ms.percentileLabels()
+	weights := make([]float64, len(keys))
+	for i, key := range keys {
+		weights[i] = counts[int32(key)]
+	}
+	indices, before, err := locatePercentiles(total, weights, ps)
+	if err != nil {
+		glog.Errorf("unable to calculate percentile: %s", err)
+		return output
+	}
+	aggName := fmt.Sprintf("%s_agg", name)
+	for i, index := range indices {
+		key := int32(keys[index])
+		value := mapping.Value(key)
+		if ms.interpolatePercentiles {
+			value = interpolateBucket(mapping, key, ps[i]*total, before[i],
+				weights[index])
+		}
+		output[fmt.Sprintf(labels[i], aggName)] = value
+	}
+	return output
+}
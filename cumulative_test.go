@@ -0,0 +1,95 @@
+package loghisto
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCumulativePercentiles(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyCumulativePercentiles("latency", 0)
+
+	for i := 0; i < 99; i++ {
+		metricSystem.Histogram("latency", 10)
+	}
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	if v := metrics["latency_agg_99"]; v < 9.9 || v > 10.1 {
+		t.Errorf("expected an aggregate p99 near 10, got %f", v)
+	}
+
+	metricSystem.Histogram("latency", 1000)
+	metricSystem.Histogram("latency", 1000)
+	metrics = metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	if v := metrics["latency_99"]; v < 990 {
+		t.Errorf("expected an interval p99 near 1000, got %f", v)
+	}
+	if v := metrics["latency_agg_99"]; v < 990 {
+		t.Errorf("expected an aggregate p99 near 1000, got %f", v)
+	}
+	if v := metrics["latency_agg_50"]; v < 9.9 || v > 10.1 {
+		t.Errorf("expected an aggregate p50 near 10, got %f", v)
+	}
+
+	// an interval without values still reports aggregate percentiles
+	metrics = metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	if _, present := metrics["latency_99"]; present {
+		t.Error("expected no interval percentiles without values")
+	}
+	if v := metrics["latency_agg_max"]; v < 990 {
+		t.Errorf("expected an aggregate max near 1000, got %f", v)
+	}
+}
+
+func TestDecayingPercentiles(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyHistogramPrecision("latency", 10)
+	metricSystem.SpecifyCumulativePercentiles("latency", time.Second)
+
+	for i := 0; i < 100; i++ {
+		metricSystem.Histogram("latency", 1000)
+	}
+	metricSystem.collectRawMetrics()
+	// after 20 half-lives the old values weigh less than minCumulativeCount
+	for i := 0; i < 20; i++ {
+		metricSystem.collectRawMetrics()
+	}
+	for i := 0; i < 10; i++ {
+		metricSystem.Histogram("latency", 1)
+	}
+	rawMetrics := metricSystem.collectRawMetrics()
+	metrics := metricSystem.processMetrics(rawMetrics).Metrics
+	if v := metrics["latency_agg_90"]; v > 1.5 {
+		t.Errorf("expected old values to have decayed, got an aggregate p90 "+
+			"of %f", v)
+	}
+	if len(rawMetrics.cumulative["latency"].counts) != 1 {
+		t.Errorf("expected fully decayed buckets to be forgotten, got %v",
+			rawMetrics.cumulative["latency"].counts)
+	}
+	if rawMetrics.cumulative["latency"].mapping != (LogMapping{Precision: 10}) {
+		t.Error("expected the snapshot to carry the histogram's mapping")
+	}
+}
+
+func TestCumulativeMatchesInterval(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.InterpolatePercentiles(true)
+	metricSystem.SpecifyCumulativePercentiles("latency", 0)
+	for i := 1; i <= 250; i++ {
+		metricSystem.Histogram("latency", float64(i*i))
+	}
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	for label := range metricSystem.percentiles {
+		name := fmt.Sprintf(label, "latency")
+		aggName := fmt.Sprintf(label, "latency_agg")
+		if metrics[aggName] != metrics[name] {
+			t.Errorf("expected %s to match %s of %f after one interval, got %f",
+				aggName, name, metrics[name], metrics[aggName])
+		}
+	}
+}
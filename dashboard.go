@@ -0,0 +1,328 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	sparklineWidth  = 240
+	sparklineHeight = 32
+	heatmapWidth    = 480
+	heatmapHeight   = 160
+	// heatmapRows is the maximum number of value bands drawn per heatmap.
+	heatmapRows = 40
+)
+
+// sparkline is a line chart of a counter rate or gauge across the
+// retained intervals.
+type sparkline struct {
+	Name   string
+	Points string
+	Last   float64
+}
+
+// heatmapCell is a rectangle of a heatmap, shaded by the fraction of an
+// interval's values that fell within its band.
+type heatmapCell struct {
+	X, Y, W, H float64
+	Opacity    float64
+}
+
+// heatmap shows the distribution of a histogram over the retained
+// intervals, with time along the x axis and value along the y axis.
+type heatmap struct {
+	Name  string
+	Min   float64
+	Max   float64
+	P50   float64
+	P99   float64
+	Cells []heatmapCell
+}
+
+type dashboardPage struct {
+	Refresh    int64
+	Time       string
+	Retained   bool
+	Counters   []sparkline
+	Gauges     []sparkline
+	Histograms []heatmap
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>loghisto</title>
+<style>
+body { font-family: monospace; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+td { padding: 2px 12px 2px 0; vertical-align: middle; }
+h2 { margin-top: 1.5em; border-bottom: 1px solid #ccc; }
+svg { background: #f8f8f8; }
+polyline { fill: none; stroke: #1f77b4; stroke-width: 1.5; }
+rect.cell { fill: #d62728; }
+</style>
+</head>
+<body>
+<h1>loghisto</h1>
+<p>{{.Time}}</p>
+{{if not .Retained}}
+<p>No intervals are retained.  Call RetainIntervals on this MetricSystem
+to populate this page.</p>
+{{end}}
+{{if .Counters}}
+<h2>counter rates</h2>
+<table>
+{{range .Counters}}<tr><td>{{.Name}}</td><td><svg width="240" height="32"><polyline points="{{.Points}}"/></svg></td><td>{{.Last}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Gauges}}
+<h2>gauges</h2>
+<table>
+{{range .Gauges}}<tr><td>{{.Name}}</td><td><svg width="240" height="32"><polyline points="{{.Points}}"/></svg></td><td>{{.Last}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Histograms}}
+<h2>histograms</h2>
+{{range .Histograms}}
+<h3>{{.Name}}</h3>
+<p>p50 {{.P50}} &middot; p99 {{.P99}} &middot; range {{.Min}} to {{.Max}}</p>
+<svg width="480" height="160">{{range .Cells}}<rect class="cell" x="{{.X}}" y="{{.Y}}" width="{{.W}}" height="{{.H}}" fill-opacity="{{.Opacity}}"/>{{end}}</svg>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// dashboard renders the retained intervals of a MetricSystem.
+type dashboard struct {
+	ms *MetricSystem
+}
+
+// DebugHandler returns an http.Handler that renders a self-contained HTML
+// page with sparklines of counter rates and gauges, and heatmaps of
+// histograms, over the intervals retained by RetainIntervals.  The page
+// refreshes itself once per interval.  It is typically mounted with:
+//
+//	http.Handle("/debug/loghisto", loghisto.DebugHandler(ms))
+func DebugHandler(ms *MetricSystem) http.Handler {
+	return &dashboard{ms: ms}
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	page := dashboardPage{
+		Refresh: int64(math.Max(d.ms.interval.Seconds(), 1)),
+		Time:    d.ms.clock.Now().String(),
+	}
+	if d.ms.retention != nil {
+		page.Retained = true
+		intervals := d.ms.retention.all()
+		page.Counters = counterSparklines(intervals)
+		page.Gauges = gaugeSparklines(intervals)
+		page.Histograms = histogramHeatmaps(intervals)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		glog.Errorf("unable to render loghisto dashboard: %s", err)
+	}
+}
+
+func counterSparklines(intervals []*retainedInterval) []sparkline {
+	return sparklines(intervals, func(rawMetrics *RawMetricSet,
+		name string) (float64, bool) {
+		if rate, present := rawMetrics.Rates[name]; present {
+			return float64(rate), true
+		}
+		rate, present := rawMetrics.FloatRates[name]
+		return rate, present
+	}, func(rawMetrics *RawMetricSet) []string {
+		names := make([]string, 0,
+			len(rawMetrics.Counters)+len(rawMetrics.FloatCounters))
+		for name := range rawMetrics.Counters {
+			names = append(names, name)
+		}
+		for name := range rawMetrics.FloatCounters {
+			names = append(names, name)
+		}
+		return names
+	})
+}
+
+func gaugeSparklines(intervals []*retainedInterval) []sparkline {
+	return sparklines(intervals, func(rawMetrics *RawMetricSet,
+		name string) (float64, bool) {
+		value, present := rawMetrics.Gauges[name]
+		return value, present
+	}, func(rawMetrics *RawMetricSet) []string {
+		names := make([]string, 0, len(rawMetrics.Gauges))
+		for name := range rawMetrics.Gauges {
+			names = append(names, name)
+		}
+		return names
+	})
+}
+
+// sparklines builds one sparkline for each name returned by names for the
+// newest interval, using value to extract its value from each interval.
+func sparklines(intervals []*retainedInterval,
+	value func(*RawMetricSet, string) (float64, bool),
+	names func(*RawMetricSet) []string) []sparkline {
+	if len(intervals) == 0 {
+		return nil
+	}
+	newest := names(intervals[len(intervals)-1].raw)
+	sort.Strings(newest)
+	lines := make([]sparkline, 0, len(newest))
+	for _, name := range newest {
+		values := make([]float64, len(intervals))
+		for i, interval := range intervals {
+			values[i], _ = value(interval.raw, name)
+		}
+		lines = append(lines, sparkline{
+			Name:   name,
+			Points: sparklinePoints(values),
+			Last:   values[len(values)-1],
+		})
+	}
+	return lines
+}
+
+// sparklinePoints scales values into the coordinates of an SVG polyline.
+func sparklinePoints(values []float64) string {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	span := max - min
+	if span == 0 {
+		span = 1
+	}
+	step := float64(sparklineWidth)
+	if len(values) > 1 {
+		step = float64(sparklineWidth) / float64(len(values)-1)
+	}
+	points := make([]string, len(values))
+	for i, v := range values {
+		y := sparklineHeight - 1 - (v-min)/span*(sparklineHeight-2)
+		points[i] = fmt.Sprintf("%.1f,%.1f", float64(i)*step, y)
+	}
+	return strings.Join(points, " ")
+}
+
+func histogramHeatmaps(intervals []*retainedInterval) []heatmap {
+	seen := make(map[string]struct{})
+	names := make([]string, 0)
+	for _, interval := range intervals {
+		for name := range interval.raw.Histograms {
+			if _, present := seen[name]; !present {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	heatmaps := make([]heatmap, 0, len(names))
+	for _, name := range names {
+		heatmaps = append(heatmaps, histogramHeatmap(name, intervals))
+	}
+	return heatmaps
+}
+
+// histogramHeatmap draws each interval as a column, divided into bands of
+// bucket keys, so that bands are spaced the same way as the histogram's
+// BucketMapping.
+func histogramHeatmap(name string, intervals []*retainedInterval) heatmap {
+	minKey, maxKey := int32(math.MaxInt32), int32(math.MinInt32)
+	mapping := DefaultMapping
+	for _, interval := range intervals {
+		if _, present := interval.raw.Histograms[name]; present {
+			mapping = interval.raw.Mapping(name)
+		}
+		for compressedValue := range interval.raw.Histograms[name] {
+			if compressedValue < minKey {
+				minKey = compressedValue
+			}
+			if compressedValue > maxKey {
+				maxKey = compressedValue
+			}
+		}
+	}
+	keysPerRow := (int(maxKey)-int(minKey))/heatmapRows + 1
+	rows := (int(maxKey)-int(minKey))/keysPerRow + 1
+	columnWidth := float64(heatmapWidth) / float64(len(intervals))
+	rowHeight := float64(heatmapHeight) / float64(rows)
+
+	h := heatmap{
+		Name: name,
+		Min:  mapping.Value(minKey),
+		Max:  mapping.Value(maxKey),
+	}
+	var latest []proportion
+	var latestCount uint64
+	for i, interval := range intervals {
+		valuesToCounts := interval.raw.Histograms[name]
+		if len(valuesToCounts) == 0 {
+			continue
+		}
+		rowCounts := make([]uint64, rows)
+		total := uint64(0)
+		latest = latest[:0]
+		for compressedValue, count := range valuesToCounts {
+			rowCounts[(int(compressedValue)-int(minKey))/keysPerRow] += *count
+			total += *count
+			latest = append(latest, proportion{
+				Value: mapping.Value(compressedValue),
+				Count: *count,
+			})
+		}
+		latestCount = total
+		for row, count := range rowCounts {
+			if count == 0 {
+				continue
+			}
+			h.Cells = append(h.Cells, heatmapCell{
+				X: float64(i) * columnWidth,
+				// larger values are drawn towards the top
+				Y:       float64(rows-row-1) * rowHeight,
+				W:       columnWidth,
+				H:       rowHeight,
+				Opacity: 0.15 + 0.85*float64(count)/float64(total),
+			})
+		}
+	}
+	if latestCount > 0 {
+		buckets, err := percentiles(latestCount, latest, []float64{.5, .99})
+		if err == nil {
+			h.P50, h.P99 = buckets[0].Value, buckets[1].Value
+		}
+	}
+	return h
+}
@@ -0,0 +1,51 @@
+package loghisto
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugHandler(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+
+	recorder := httptest.NewRecorder()
+	DebugHandler(metricSystem).ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/debug/loghisto", nil))
+	if !strings.Contains(recorder.Body.String(), "No intervals are retained") {
+		t.Error("expected a notice when no intervals are retained")
+	}
+
+	metricSystem.RetainIntervals(4)
+	metricSystem.RegisterGaugeFunc("queue_depth", func() float64 { return 7 })
+	for i := 0; i < 3; i++ {
+		metricSystem.Counter("requests", uint64(i+1))
+		metricSystem.Histogram("latency", float64(100*(i+1)))
+		metricSystem.Histogram("latency", 5)
+		metricSystem.retention.retainRaw(metricSystem.collectRawMetrics())
+	}
+
+	recorder = httptest.NewRecorder()
+	DebugHandler(metricSystem).ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/debug/loghisto", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"requests", "queue_depth", "latency", "<polyline", "<rect",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected dashboard to contain %q", expected)
+		}
+	}
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+		"text/html") {
+		t.Errorf("expected an html content type, got %q", ct)
+	}
+}
+
+func TestSparklinePoints(t *testing.T) {
+	points := sparklinePoints([]float64{0, 10})
+	if points != "0.0,31.0 240.0,1.0" {
+		t.Errorf("unexpected sparkline points %q", points)
+	}
+}
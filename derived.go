@@ -0,0 +1,486 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// exprNode is a node of a parsed expression.
+type exprNode interface {
+	// eval returns the value of the node, or false if a metric it refers
+	// to is absent from the interval.
+	eval(ctx *exprContext) (float64, bool)
+}
+
+// exprContext is the interval an expression is evaluated over.
+type exprContext struct {
+	ms         *MetricSystem
+	rawMetrics *RawMetricSet
+	metrics    map[string]float64
+	// idleRates reports a rate of 0 for counters of rawMetrics that were
+	// not incremented, which processing leaves without a _rate.
+	idleRates bool
+}
+
+type numberNode float64
+
+func (n numberNode) eval(ctx *exprContext) (float64, bool) {
+	return float64(n), true
+}
+
+// metricNode refers to a processed metric, such as requests_rate.
+type metricNode string
+
+func (n metricNode) eval(ctx *exprContext) (float64, bool) {
+	value, present := ctx.metrics[string(n)]
+	if !present && ctx.idleRates && strings.HasSuffix(string(n), "_rate") {
+		name := strings.TrimSuffix(string(n), "_rate")
+		_, counted := ctx.rawMetrics.Counters[name]
+		_, floatCounted := ctx.rawMetrics.FloatCounters[name]
+		return 0, counted || floatCounted
+	}
+	return value, present
+}
+
+type negateNode struct {
+	operand exprNode
+}
+
+func (n negateNode) eval(ctx *exprContext) (float64, bool) {
+	value, ok := n.operand.eval(ctx)
+	return -value, ok
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+func (n binaryNode) eval(ctx *exprContext) (float64, bool) {
+	left, ok := n.left.eval(ctx)
+	if !ok {
+		return 0, false
+	}
+	right, ok := n.right.eval(ctx)
+	if !ok {
+		return 0, false
+	}
+	switch n.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	}
+	return left / right, true
+}
+
+// percentileNode calculates a percentile of a histogram from its raw
+// buckets, so it need not be one of the MetricSystem's percentiles.
+type percentileNode struct {
+	histogram  string
+	percentile float64
+}
+
+func (n percentileNode) eval(ctx *exprContext) (float64, bool) {
+	if backend, present := ctx.rawMetrics.Backends[n.histogram]; present {
+		return backend.Quantiles([]float64{n.percentile})[0], true
+	}
+	valuesToCounts, present := ctx.rawMetrics.Histograms[n.histogram]
+	if !present {
+		return 0, false
+	}
+	mapping := ctx.rawMetrics.Mapping(n.histogram)
+	totalCount := uint64(0)
+	proportions := make(proportionArray, 0, len(valuesToCounts))
+	for compressedValue, count := range valuesToCounts {
+		totalCount += *count
+		proportions = append(proportions, proportion{
+			Value: mapping.Value(compressedValue),
+			Count: *count,
+			Key:   compressedValue,
+		})
+	}
+	buckets, err := percentiles(totalCount, proportions,
+		[]float64{n.percentile})
+	if err != nil {
+		return 0, false
+	}
+	if ctx.ms.interpolatePercentiles {
+		return buckets[0].interpolate(n.percentile, totalCount, mapping), true
+	}
+	return buckets[0].Value, true
+}
+
+// sumNode sums every processed metric matching a path.Match pattern.
+type sumNode string
+
+func (n sumNode) eval(ctx *exprContext) (float64, bool) {
+	sum := float64(0)
+	for name, value := range ctx.metrics {
+		if matched, _ := path.Match(string(n), name); matched {
+			sum += value
+		}
+	}
+	return sum, true
+}
+
+// exprToken is a lexical token of an expression.  kind is one of the
+// operator or punctuation characters, or 'n' for numbers, 'i' for
+// identifiers, 's' for quoted strings and 'c' for comparisons.
+type exprToken struct {
+	kind byte
+	text string
+}
+
+// isNameRune returns whether r may appear in an unquoted metric name.
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' ||
+		r == '.' || r == ':'
+}
+
+// numberLength returns the length of the number at the start of runes.
+func numberLength(runes []rune) int {
+	end := 0
+	for end < len(runes) && (unicode.IsDigit(runes[end]) ||
+		runes[end] == '.' || runes[end] == 'e' || runes[end] == 'E' ||
+		(end > 0 && (runes[end] == '-' || runes[end] == '+') &&
+			(runes[end-1] == 'e' || runes[end-1] == 'E'))) {
+		end++
+	}
+	return end
+}
+
+func tokenize(expr string) ([]exprToken, error) {
+	var tokens []exprToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("+-*/(),", r):
+			tokens = append(tokens, exprToken{kind: byte(r)})
+			i++
+		case strings.ContainsRune("<>=!", r):
+			op := string(r)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", r, i)
+			}
+			tokens = append(tokens, exprToken{'c', op})
+			i += len(op)
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			tokens = append(tokens, exprToken{'s', string(runes[i+1 : end])})
+			i = end + 1
+		case unicode.IsDigit(r) || r == '.':
+			end := i + numberLength(runes[i:])
+			if end == len(runes) || !isNameRune(runes[end]) {
+				tokens = append(tokens, exprToken{'n', string(runes[i:end])})
+				i = end
+				break
+			}
+			// names such as 5xx_rate start with a number, as do
+			// quantities such as 250ms, which the parser splits again
+			for end < len(runes) && isNameRune(runes[end]) {
+				end++
+			}
+			tokens = append(tokens, exprToken{'i', string(runes[i:end])})
+			i = end
+		case isNameRune(r):
+			end := i
+			for end < len(runes) && isNameRune(runes[end]) {
+				end++
+			}
+			tokens = append(tokens, exprToken{'i', string(runes[i:end])})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", r, i)
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser is a recursive descent parser of the grammar:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = "-" factor | number | name | call | "(" expr ")"
+//	call   = "percentile" "(" name "," number ")" | "sum" "(" string ")"
+//
+// where a name is either unquoted or a quoted string.
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+// parseExpr parses an expression of a derived metric.
+func parseExpr(expr string) (exprNode, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s after expression", p.peek())
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	if p.pos >= len(p.tokens) {
+		return exprToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (t exprToken) String() string {
+	switch t.kind {
+	case 0:
+		return "end of expression"
+	case 'n', 'i', 'c':
+		return strconv.Quote(t.text)
+	case 's':
+		return fmt.Sprintf("string %q", t.text)
+	}
+	return strconv.QuoteRune(rune(t.kind))
+}
+
+// expect consumes a token of kind, or returns an error.
+func (p *exprParser) expect(kind byte) (exprToken, error) {
+	token := p.peek()
+	if token.kind != kind {
+		return token, fmt.Errorf("expected %s, found %s",
+			exprToken{kind: kind}, token)
+	}
+	p.pos++
+	return token, nil
+}
+
+func (p *exprParser) expr() (exprNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek().kind; op == '+' || op == '-'; op = p.peek().kind {
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) term() (exprNode, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek().kind; op == '*' || op == '/'; op = p.peek().kind {
+		p.pos++
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) factor() (exprNode, error) {
+	token := p.peek()
+	switch token.kind {
+	case '-':
+		p.pos++
+		operand, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return negateNode{operand}, nil
+	case '(':
+		p.pos++
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case 'n':
+		p.pos++
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token.text)
+		}
+		return numberNode(value), nil
+	case 's':
+		p.pos++
+		return metricNode(token.text), nil
+	case 'i':
+		p.pos++
+		if p.peek().kind == '(' {
+			return p.call(token.text)
+		}
+		return metricNode(token.text), nil
+	}
+	return nil, fmt.Errorf("unexpected %s", token)
+}
+
+func (p *exprParser) call(function string) (exprNode, error) {
+	p.pos++ // (
+	var node exprNode
+	switch function {
+	case "percentile":
+		histogram := p.peek()
+		if histogram.kind != 'i' && histogram.kind != 's' {
+			return nil, fmt.Errorf("expected a histogram name, found %s",
+				histogram)
+		}
+		p.pos++
+		if _, err := p.expect(','); err != nil {
+			return nil, err
+		}
+		number, err := p.expect('n')
+		if err != nil {
+			return nil, err
+		}
+		percentile, err := strconv.ParseFloat(number.text, 64)
+		if err != nil || percentile < 0 || percentile > 1 {
+			return nil, fmt.Errorf("percentile %s is not between 0 and 1",
+				number.text)
+		}
+		node = percentileNode{histogram.text, percentile}
+	case "sum":
+		pattern, err := p.expect('s')
+		if err != nil {
+			return nil, err
+		}
+		if _, err := path.Match(pattern.text, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", pattern.text, err)
+		}
+		node = sumNode(pattern.text)
+	default:
+		return nil, fmt.Errorf("unknown function %s", function)
+	}
+	if _, err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// derivedMetric is a metric calculated from the others of each interval.
+type derivedMetric struct {
+	name string
+	expr exprNode
+}
+
+// derivedMetrics holds the derived metrics of a MetricSystem in the order
+// they are evaluated.  It is shared by a MetricSystem and its rollup tiers.
+type derivedMetrics struct {
+	mu      sync.RWMutex
+	metrics []*derivedMetric
+}
+
+// RegisterDerived publishes a metric calculated at every interval from the
+// processed metrics of the interval.  The expression supports + - * / and
+// parentheses over numbers and metric names, such as
+//
+//	errors_rate / requests_rate
+//
+// along with percentile(histogram, p), which calculates any percentile of
+// a histogram, and sum("pattern"), which sums the metrics matching a
+// path.Match pattern such as "rpc.*_rate".  Metric names that are not
+// made of letters, digits, '_', '.' and ':' may be quoted, while those
+// such as 5xx_rate that start with a digit need not be.  Derived metrics
+// are evaluated in the order they are first registered, so each may refer
+// to those registered before it.  They are evaluated once every other
+// output of an interval, including aggregates such as <name>_agg_avg, has
+// been calculated.  A derived metric is not published in intervals missing
+// a metric it refers to, nor when its value is not finite, such as after
+// dividing by a rate of 0.
+func (ms *MetricSystem) RegisterDerived(name, expr string) error {
+	node, err := parseExpr(expr)
+	if err != nil {
+		return fmt.Errorf("unable to parse derived metric %s: %s", name, err)
+	}
+	d := ms.derived
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, existing := range d.metrics {
+		if existing.name == name {
+			existing.expr = node
+			return nil
+		}
+	}
+	d.metrics = append(d.metrics, &derivedMetric{name: name, expr: node})
+	return nil
+}
+
+// DeregisterDerived stops publishing a derived metric.
+func (ms *MetricSystem) DeregisterDerived(name string) {
+	d := ms.derived
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, existing := range d.metrics {
+		if existing.name == name {
+			d.metrics = append(d.metrics[:i], d.metrics[i+1:]...)
+			return
+		}
+	}
+}
+
+// addDerived evaluates the derived metrics of an interval, adding the
+// finite ones to metrics and recording them as their own sources.
+func (ms *MetricSystem) addDerived(rawMetrics *RawMetricSet,
+	metrics map[string]float64, sources map[string]string) {
+	d := ms.derived
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ctx := &exprContext{ms: ms, rawMetrics: rawMetrics, metrics: metrics}
+	for _, derived := range d.metrics {
+		value, ok := derived.expr.eval(ctx)
+		if ok && !math.IsNaN(value) && !math.IsInf(value, 0) {
+			metrics[derived.name] = value
+			sources[derived.name] = derived.name
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package loghisto
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// publishInterval collects, processes and publishes an interval, returning
+// the ProcessedMetricSet sent to subscribers.
+func publishInterval(ms *MetricSystem) *ProcessedMetricSet {
+	processedMetricStream := make(chan *ProcessedMetricSet, 1)
+	ms.SubscribeToProcessedMetrics(processedMetricStream)
+	defer ms.UnsubscribeFromProcessedMetrics(processedMetricStream)
+	processChan := make(chan func(), 1)
+	ms.publish(ms.collectRawMetrics(), processChan)
+	(<-processChan)()
+	return <-processedMetricStream
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	rules := map[string]string{
+		"error_ratio":   "errors_rate / requests_rate",
+		"error_percent": "100 * error_ratio",
+		"rpc_total":     `sum("rpc.*_rate")`,
+		"latency_p999":  "percentile(latency, 0.999)",
+		"negated":       "-(requests - errors) * 2",
+		"quoted":        `"some requests" + 1`,
+		"missing":       "requests / absent",
+		"server_errors": "5xx_rate / requests_rate",
+	}
+	for _, name := range []string{"error_ratio", "error_percent", "rpc_total",
+		"latency_p999", "negated", "quoted", "missing", "server_errors"} {
+		if err := metricSystem.RegisterDerived(name, rules[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metricSystem.Counter("requests", 8)
+	metricSystem.Counter("errors", 2)
+	metricSystem.Counter("5xx", 4)
+	metricSystem.Counter("some requests", 4)
+	metricSystem.Counter("rpc.get", 3)
+	metricSystem.Counter("rpc.put", 5)
+	for i := 0; i < 99; i++ {
+		metricSystem.Histogram("latency", 10)
+	}
+	metricSystem.Histogram("latency", 1000)
+
+	metrics := publishInterval(metricSystem).Metrics
+	expected := map[string]float64{
+		"error_ratio":   0.25,
+		"error_percent": 25,
+		"rpc_total":     8,
+		"negated":       -12,
+		"quoted":        5,
+		"server_errors": 0.5,
+	}
+	for name, value := range expected {
+		if v, present := metrics[name]; !present || math.Abs(v-value) > 1e-9 {
+			t.Errorf("expected %s to be %f, got %f", name, value, v)
+		}
+	}
+	if v := metrics["latency_p999"]; v < 990 || v > 1010 {
+		t.Errorf("expected latency_p999 near 1000, got %f", v)
+	}
+	if _, present := metrics["missing"]; present {
+		t.Error("expected no derived metric when a metric it uses is missing")
+	}
+
+	metricSystem.DeregisterDerived("error_ratio")
+	metricSystem.Counter("requests", 1)
+	metricSystem.Counter("errors", 1)
+	metrics = publishInterval(metricSystem).Metrics
+	if _, present := metrics["error_ratio"]; present {
+		t.Error("expected no error_ratio after deregistering it")
+	}
+	if _, present := metrics["error_percent"]; present {
+		t.Error("expected no error_percent without error_ratio")
+	}
+}
+
+func TestDerivedAggregatesAndDivisionByZero(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	for name, expr := range map[string]string{
+		"doubled_avg": "latency_agg_avg * 2",
+		"error_ratio": "errors_rate / requests_rate",
+		"overflow":    "1e308 * 10",
+	} {
+		if err := metricSystem.RegisterDerived(name, expr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metricSystem.Histogram("latency", 10)
+	metricSystem.Counter("requests", 0)
+	metricSystem.Counter("errors", 0)
+
+	metrics := publishInterval(metricSystem).Metrics
+	if v, present := metrics["doubled_avg"]; !present ||
+		v != 2*metrics["latency_agg_avg"] {
+		t.Errorf("expected doubled_avg to be twice latency_agg_avg of %f, "+
+			"got %f", metrics["latency_agg_avg"], v)
+	}
+	for _, name := range []string{"error_ratio", "overflow"} {
+		if v, present := metrics[name]; present {
+			t.Errorf("expected no non-finite %s, got %f", name, v)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"a +",
+		"(a",
+		"a b",
+		"percentile(latency, 2)",
+		"percentile(latency)",
+		`sum(requests)`,
+		`sum("[")`,
+		"max(a)",
+		`"unterminated`,
+		"a % b",
+	} {
+		if _, err := parseExpr(expr); err == nil {
+			t.Errorf("expected an error parsing %q", expr)
+		}
+	}
+}
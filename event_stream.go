@@ -0,0 +1,191 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// eventStreamEvent is the JSON payload of each Server-Sent Event.
+type eventStreamEvent struct {
+	Time    int64              `json:"time"`
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+// eventStreamBuffer is the number of intervals buffered for each client.
+const eventStreamBuffer = 16
+
+// eventStream serves the processed metric stream of a MetricSystem.  It
+// holds a single subscription to the MetricSystem, shared by all of its
+// clients, so that clients connecting and disconnecting never wait on the
+// reaper.
+type eventStream struct {
+	ms *MetricSystem
+	// mu controls access to clients and subscribed.
+	mu      sync.Mutex
+	clients map[chan *ProcessedMetricSet]struct{}
+	// subscribed is whether the shared subscription is active.
+	subscribed bool
+}
+
+// EventStreamHandler returns an http.Handler that streams each
+// ProcessedMetricSet of a MetricSystem to its clients as Server-Sent
+// Events.  Each event carries a JSON object with the Unix time of the
+// interval and its metrics.  Clients may pass one or more "name" query
+// parameters, each a metric name or a path.Match pattern such as
+// "rpc_*_99", to receive only matching metrics.
+func EventStreamHandler(ms *MetricSystem) http.Handler {
+	return &eventStream{
+		ms:      ms,
+		clients: make(map[chan *ProcessedMetricSet]struct{}),
+	}
+}
+
+// addClient returns a channel receiving each ProcessedMetricSet, starting
+// the shared subscription if needed.
+func (es *eventStream) addClient() chan *ProcessedMetricSet {
+	client := make(chan *ProcessedMetricSet, eventStreamBuffer)
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if !es.subscribed {
+		metricStream := make(chan *ProcessedMetricSet, eventStreamBuffer)
+		es.ms.SubscribeToProcessedMetrics(metricStream)
+		es.subscribed = true
+		go es.broadcast(metricStream)
+	}
+	es.clients[client] = struct{}{}
+	return client
+}
+
+// removeClient stops sending to a client.
+func (es *eventStream) removeClient(client chan *ProcessedMetricSet) {
+	es.mu.Lock()
+	delete(es.clients, client)
+	es.mu.Unlock()
+}
+
+// broadcast forwards the shared subscription to every client.  Clients
+// that fall a whole buffer behind are disconnected rather than blocking the
+// others.  If the MetricSystem gives up on the subscription, every client
+// is disconnected, and the next client subscribes again.
+func (es *eventStream) broadcast(metricStream chan *ProcessedMetricSet) {
+	for processedMetrics := range metricStream {
+		es.mu.Lock()
+		for client := range es.clients {
+			select {
+			case client <- processedMetrics:
+			default:
+				glog.Error("an event stream client has fallen too far behind. ",
+					"disconnecting it rather than blocking.")
+				delete(es.clients, client)
+				close(client)
+			}
+		}
+		es.mu.Unlock()
+	}
+
+	es.mu.Lock()
+	for client := range es.clients {
+		delete(es.clients, client)
+		close(client)
+	}
+	es.subscribed = false
+	es.mu.Unlock()
+}
+
+func (es *eventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported by this connection",
+			http.StatusInternalServerError)
+		return
+	}
+	patterns := r.URL.Query()["name"]
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			http.Error(w, fmt.Sprintf("invalid name pattern %q: %s", pattern,
+				err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	metricStream := es.addClient()
+	defer es.removeClient(metricStream)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case processedMetrics, ok := <-metricStream:
+			if !ok {
+				// we fell too far behind and were disconnected
+				return
+			}
+			event, err := json.Marshal(eventStreamEvent{
+				Time:    processedMetrics.Time.Unix(),
+				Metrics: filterMetrics(processedMetrics.Metrics, patterns),
+			})
+			if err != nil {
+				glog.Errorf("unable to encode metric event: %s", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: metrics\ndata: %s\n\n",
+				event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// filterMetrics returns the metrics whose names match any of patterns, or
+// all metrics if there are no patterns.  Values that JSON cannot represent,
+// such as the NaN mean of an empty histogram, are dropped.
+func filterMetrics(metrics map[string]float64,
+	patterns []string) map[string]float64 {
+	filtered := make(map[string]float64)
+	for name, value := range metrics {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		if len(patterns) == 0 {
+			filtered[name] = value
+			continue
+		}
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				filtered[name] = value
+				break
+			}
+		}
+	}
+	return filtered
+}
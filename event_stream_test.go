@@ -0,0 +1,102 @@
+package loghisto
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spacejam/loghisto/clocktest"
+)
+
+func TestEventStreamHandler(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(0, 1))
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetClock(clock)
+	metricSystem.Start()
+	defer metricSystem.Stop()
+
+	server := httptest.NewServer(EventStreamHandler(metricSystem))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?name=rpc_*&name=other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream content type, got %q", ct)
+	}
+
+	metricSystem.Counter("rpc_calls", 3)
+	metricSystem.Counter("unrelated", 3)
+	clock.BlockUntil(1)
+	clock.Set(time.Unix(1, 0))
+
+	received := make(chan eventStreamEvent, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var event eventStreamEvent
+			if err := json.Unmarshal([]byte(line[len("data: "):]),
+				&event); err != nil {
+				t.Error(err)
+			}
+			received <- event
+			return
+		}
+	}()
+
+	select {
+	case event := <-received:
+		if event.Time != 1 {
+			t.Errorf("expected event time of 1, got %d", event.Time)
+		}
+		if event.Metrics["rpc_calls_rate"] != 3 {
+			t.Errorf("expected rpc_calls_rate of 3, got %v", event.Metrics)
+		}
+		if _, present := event.Metrics["unrelated"]; present {
+			t.Error("expected unrelated metrics to be filtered out")
+		}
+	case <-time.After(time.Second):
+		t.Error("received no events from the stream")
+	}
+}
+
+func TestEventStreamBadPattern(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	EventStreamHandler(NewMetricSystem(time.Second, false)).ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/?name=[", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad request status, got %d", recorder.Code)
+	}
+}
+
+func TestEventStreamReconnects(t *testing.T) {
+	// the MetricSystem is never started, so nothing drains its subscription
+	// channels
+	handler := EventStreamHandler(NewMetricSystem(time.Second, false))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			handler.ServeHTTP(httptest.NewRecorder(),
+				httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected clients to connect and disconnect without blocking")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"sort"
+	"time"
+)
+
+// Exemplar is an example of a value recorded in a histogram bucket, which
+// links the bucket to the trace of the request that produced it.
+type Exemplar struct {
+	TraceID string
+	Value   float64
+	Time    time.Time
+}
+
+// HistogramWithExemplar records the value of an exemplar like Histogram,
+// and keeps the exemplar for its bucket if it is the most recent exemplar
+// of the bucket recorded in this interval.  An exemplar without a Time is
+// stamped with the current time.  Exemplars are only kept for histograms
+// that use a BucketMapping.
+func (ms *MetricSystem) HistogramWithExemplar(name string,
+	exemplar Exemplar) {
+	ms.Histogram(name, exemplar.Value)
+	settings := ms.loadHistogramSettings()
+	if _, custom := settings.backends[name]; custom {
+		return
+	}
+	if exemplar.Time.IsZero() {
+		exemplar.Time = ms.clock.Now()
+	}
+	key := settings.mapping(name).Key(exemplar.Value)
+
+	ms.exemplarMu.Lock()
+	bucketExemplars, present := ms.exemplarCache[name]
+	if !present {
+		bucketExemplars = make(map[int32]Exemplar)
+		ms.exemplarCache[name] = bucketExemplars
+	}
+	bucketExemplars[key] = exemplar
+	ms.exemplarMu.Unlock()
+}
+
+// collectExemplars swaps out the exemplars recorded in an interval, keeping
+// those of histograms that were not dropped at collection.
+func (ms *MetricSystem) collectExemplars(
+	histograms map[string]map[int32]*uint64) map[string]map[int32]Exemplar {
+	ms.exemplarMu.Lock()
+	exemplars := ms.exemplarCache
+	ms.exemplarCache = make(map[string]map[int32]Exemplar)
+	ms.exemplarMu.Unlock()
+
+	for name := range exemplars {
+		if _, present := histograms[name]; !present {
+			delete(exemplars, name)
+		}
+	}
+	return exemplars
+}
+
+// exemplarBucket is a bucket of a histogram recorded with exemplars.
+type exemplarBucket struct {
+	upper float64
+	// cumulative is the count of this bucket and every bucket below it.
+	cumulative  uint64
+	exemplar    Exemplar
+	hasExemplar bool
+}
+
+// exemplarHistogram is the interval distribution of a histogram recorded
+// with exemplars, in ascending order of buckets, for exposition as an
+// OpenMetrics gauge histogram.
+type exemplarHistogram struct {
+	buckets []exemplarBucket
+	count   uint64
+	sum     float64
+}
+
+// newExemplarHistogram attaches the exemplars of a histogram to its
+// buckets.
+func newExemplarHistogram(valuesToCounts map[int32]*uint64,
+	mapping BucketMapping, exemplars map[int32]Exemplar) *exemplarHistogram {
+	keys := make([]int, 0, len(valuesToCounts))
+	for key := range valuesToCounts {
+		keys = append(keys, int(key))
+	}
+	// keys of a BucketMapping are ordered like their values
+	sort.Ints(keys)
+
+	h := &exemplarHistogram{buckets: make([]exemplarBucket, len(keys))}
+	for i, key := range keys {
+		count := *valuesToCounts[int32(key)]
+		h.count += count
+		h.sum += mapping.Value(int32(key)) * float64(count)
+		_, upper := mapping.Bounds(int32(key))
+		exemplar, present := exemplars[int32(key)]
+		h.buckets[i] = exemplarBucket{
+			upper:       upper,
+			cumulative:  h.count,
+			exemplar:    exemplar,
+			hasExemplar: present,
+		}
+	}
+	return h
+}
@@ -0,0 +1,98 @@
+package loghisto
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spacejam/loghisto/clocktest"
+)
+
+func TestHistogramWithExemplar(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(100, 0))
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetClock(clock)
+
+	for i := 0; i < 99; i++ {
+		metricSystem.Histogram("latency", 10)
+	}
+	metricSystem.HistogramWithExemplar("latency",
+		Exemplar{TraceID: "fast", Value: 10})
+	metricSystem.HistogramWithExemplar("latency",
+		Exemplar{TraceID: "slow-1", Value: 5000})
+	clock.Advance(time.Millisecond)
+	metricSystem.HistogramWithExemplar("latency",
+		Exemplar{TraceID: "slow-2", Value: 5000})
+	// exemplars may carry the time of their trace
+	metricSystem.HistogramWithExemplar("latency",
+		Exemplar{TraceID: "old", Value: 1e6, Time: time.Unix(50, 0)})
+
+	rawMetrics := metricSystem.collectRawMetrics()
+	exemplar := rawMetrics.Exemplars["latency"][DefaultMapping.Key(5000)]
+	if exemplar.TraceID != "slow-2" || exemplar.Value != 5000 ||
+		!exemplar.Time.Equal(time.Unix(100, int64(time.Millisecond))) {
+		t.Errorf("expected the most recent exemplar of the bucket, got %+v",
+			exemplar)
+	}
+
+	processed := metricSystem.processMetrics(rawMetrics)
+	if processed.Exemplars["latency_99"].TraceID != "slow-2" {
+		t.Errorf("expected the p99 to link to slow-2, got %+v",
+			processed.Exemplars["latency_99"])
+	}
+	if exemplar := processed.Exemplars["latency_max"]; exemplar.TraceID !=
+		"old" || !exemplar.Time.Equal(time.Unix(50, 0)) {
+		t.Errorf("expected the max to link to old at its own time, got %+v",
+			exemplar)
+	}
+	if processed.Exemplars["latency_50"].TraceID != "fast" {
+		t.Errorf("expected the median to link to fast, got %+v",
+			processed.Exemplars["latency_50"])
+	}
+
+	serialized := string(OpenMetricsProtocol(processed))
+	_, upper := DefaultMapping.Bounds(DefaultMapping.Key(5000))
+	for _, line := range []string{
+		"# TYPE latency gaugehistogram\n",
+		fmt.Sprintf(`latency_bucket{le="%s"} 102 # {trace_id="slow-2"} 5000 `+
+			"100.001\n", prometheusValue(upper)),
+		`latency_bucket{le="+Inf"} 103` + "\n",
+		"latency_gcount 103\n",
+		"latency_max 1",
+	} {
+		if !strings.Contains(serialized, line) {
+			t.Errorf("expected %q in:\n%s", line, serialized)
+		}
+	}
+	if strings.Count(serialized, "# {") != 3 {
+		t.Errorf("expected exemplars only on the 3 buckets that have them, "+
+			"got:\n%s", serialized)
+	}
+	for _, line := range strings.Split(serialized, "\n") {
+		if strings.Contains(line, "# {") &&
+			!strings.HasPrefix(line, "latency_bucket{") {
+			t.Errorf("expected exemplars only on bucket samples, got %q", line)
+		}
+	}
+
+	if len(metricSystem.collectRawMetrics().Exemplars) != 0 {
+		t.Error("expected exemplars to be reset at each interval")
+	}
+}
+
+func TestRollupExemplars(t *testing.T) {
+	r := newRollup(2*time.Second, GaugeLast, nil)
+	for i := int64(1); i <= 2; i++ {
+		rawMetrics := NewMetricSystem(time.Second, false).collectRawMetrics()
+		rawMetrics.Time = time.Unix(i, 0)
+		rawMetrics.Exemplars = map[string]map[int32]Exemplar{
+			"latency": {7: {TraceID: string(rune('a' + i)), Time: time.Unix(i, 0)}},
+		}
+		if completed := r.merge(rawMetrics); i == 2 {
+			if exemplar := completed[0].Exemplars["latency"][7]; exemplar.TraceID != "c" {
+				t.Errorf("expected the latest exemplar to win, got %+v", exemplar)
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Gauge is a value that is set by events, such as the depth of a queue,
+// rather than polled like the functions passed to RegisterGaugeFunc.  Its
+// current value is reported in RawMetricSet.Gauges at each interval.
+type Gauge struct {
+	name string
+	// bits holds the float64 value of the gauge.
+	bits uint64
+}
+
+// Set replaces the value of the gauge.
+func (g *Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+// Add adds delta to the value of the gauge.
+func (g *Gauge) Add(delta float64) {
+	addFloat64(&g.bits, delta)
+}
+
+// Sub subtracts delta from the value of the gauge.
+func (g *Gauge) Sub(delta float64) {
+	addFloat64(&g.bits, -delta)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Name returns the name of the gauge.
+func (g *Gauge) Name() string {
+	return g.name
+}
+
+// addFloat64 atomically adds delta to the float64 whose bits are at addr.
+func addFloat64(addr *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(addr, old, next) {
+			return
+		}
+	}
+}
+
+// UpDownCounter is a signed count that may decrease as well as increase,
+// such as the number of requests in flight.  Unlike a Counter, its current
+// value rather than its rate is reported in RawMetricSet.Gauges at each
+// interval.
+type UpDownCounter struct {
+	name  string
+	count int64
+}
+
+// Add adds delta, which may be negative, to the counter.
+func (c *UpDownCounter) Add(delta int64) {
+	atomic.AddInt64(&c.count, delta)
+}
+
+// Inc increments the counter by 1.
+func (c *UpDownCounter) Inc() {
+	atomic.AddInt64(&c.count, 1)
+}
+
+// Dec decrements the counter by 1.
+func (c *UpDownCounter) Dec() {
+	atomic.AddInt64(&c.count, -1)
+}
+
+// Value returns the current value of the counter.
+func (c *UpDownCounter) Value() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+// Name returns the name of the counter.
+func (c *UpDownCounter) Name() string {
+	return c.name
+}
+
+// NewGauge returns the named Gauge, creating it with a value of 0 if it
+// does not exist yet.
+func (ms *MetricSystem) NewGauge(name string) *Gauge {
+	ms.pushGaugesMu.Lock()
+	defer ms.pushGaugesMu.Unlock()
+	g, present := ms.gauges[name]
+	if !present {
+		g = &Gauge{name: name}
+		ms.gauges[name] = g
+	}
+	return g
+}
+
+// NewUpDownCounter returns the named UpDownCounter, creating it with a
+// value of 0 if it does not exist yet.
+func (ms *MetricSystem) NewUpDownCounter(name string) *UpDownCounter {
+	ms.pushGaugesMu.Lock()
+	defer ms.pushGaugesMu.Unlock()
+	c, present := ms.upDownCounters[name]
+	if !present {
+		c = &UpDownCounter{name: name}
+		ms.upDownCounters[name] = c
+	}
+	return c
+}
+
+// RemoveGauge stops reporting the named Gauge or UpDownCounter.  Handles
+// that are still held may be updated, but are no longer reported.
+func (ms *MetricSystem) RemoveGauge(name string) {
+	ms.pushGaugesMu.Lock()
+	delete(ms.gauges, name)
+	delete(ms.upDownCounters, name)
+	ms.pushGaugesMu.Unlock()
+}
+
+// collectGauges adds the current value of every Gauge and UpDownCounter to
+// gauges.
+func (ms *MetricSystem) collectGauges(gauges map[string]float64) {
+	ms.pushGaugesMu.Lock()
+	defer ms.pushGaugesMu.Unlock()
+	for name, g := range ms.gauges {
+		gauges[name] = g.Value()
+	}
+	for name, c := range ms.upDownCounters {
+		gauges[name] = float64(c.Value())
+	}
+}
@@ -0,0 +1,78 @@
+package loghisto
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGauge(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	g := metricSystem.NewGauge("queue.depth")
+	if metricSystem.NewGauge("queue.depth") != g {
+		t.Error("expected the same gauge for the same name")
+	}
+
+	g.Set(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				g.Add(1.5)
+				g.Sub(.5)
+			}
+		}()
+	}
+	wg.Wait()
+
+	rawMetrics := metricSystem.collectRawMetrics()
+	if rawMetrics.Gauges["queue.depth"] != 810 {
+		t.Errorf("expected 810, got %f", rawMetrics.Gauges["queue.depth"])
+	}
+	// gauges keep their value across intervals
+	rawMetrics = metricSystem.collectRawMetrics()
+	if rawMetrics.Gauges["queue.depth"] != 810 {
+		t.Errorf("expected 810 again, got %f", rawMetrics.Gauges["queue.depth"])
+	}
+
+	metricSystem.RemoveGauge("queue.depth")
+	if _, present := metricSystem.collectRawMetrics().Gauges["queue.depth"]; present {
+		t.Error("expected a removed gauge not to be reported")
+	}
+}
+
+func TestUpDownCounter(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	c := metricSystem.NewUpDownCounter("requests.inflight")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc()
+				c.Dec()
+			}
+			c.Add(-2)
+		}()
+	}
+	wg.Wait()
+
+	if c.Value() != -16 {
+		t.Errorf("expected -16, got %d", c.Value())
+	}
+	processed := metricSystem.processMetrics(metricSystem.collectRawMetrics())
+	if processed.Metrics["requests.inflight"] != -16 {
+		t.Errorf("expected -16, got %f",
+			processed.Metrics["requests.inflight"])
+	}
+
+	serialized := string(GraphiteProtocol(processed))
+	if !strings.Contains(serialized, "requests.inflight -16.000000") {
+		t.Errorf("expected the counter to be serialized, got %q", serialized)
+	}
+}
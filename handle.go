@@ -0,0 +1,246 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// handleChunkSize is the number of buckets allocated at a time by a
+	// HistogramHandle.
+	handleChunkSize = 64
+	// maxHandleChunks bounds the memory of a HistogramHandle.  Values whose
+	// buckets lie too far from the others are recorded through Histogram.
+	maxHandleChunks = 1 << 14
+)
+
+// CounterHandle is a Counter bound to its own storage, so that updating it
+// only costs an atomic add.  reaper() drains it at each interval.
+type CounterHandle struct {
+	name  string
+	count uint64
+}
+
+// Inc increments the counter by 1.
+func (h *CounterHandle) Inc() {
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Add increments the counter by amount.
+func (h *CounterHandle) Add(amount uint64) {
+	atomic.AddUint64(&h.count, amount)
+}
+
+// Name returns the name of the counter.
+func (h *CounterHandle) Name() string {
+	return h.name
+}
+
+// bucketChunk is a contiguous run of bucket counts of a HistogramHandle.
+type bucketChunk [handleChunkSize]uint64
+
+// handleBuckets maps the bucket keys of a HistogramHandle to their counts.
+// It is immutable apart from the counts themselves: growing replaces it
+// with a copy that shares the existing chunks, so that no concurrent
+// increment of an old handleBuckets is lost.
+type handleBuckets struct {
+	// base is the bucket key of the first count of chunks[0].
+	base   int64
+	chunks []*bucketChunk
+}
+
+// count returns the count of a bucket key, or nil if it is not covered.
+func (b *handleBuckets) count(key int32) *uint64 {
+	i := int64(key) - b.base
+	if i < 0 || i >= int64(len(b.chunks))*handleChunkSize {
+		return nil
+	}
+	return &b.chunks[i/handleChunkSize][i%handleChunkSize]
+}
+
+// HistogramHandle is a Histogram bound to its own storage, so that
+// recording a value only costs computing its bucket and an atomic add.
+// reaper() drains it at each interval.  It keeps using the BucketMapping
+// the histogram had when the handle was created.
+type HistogramHandle struct {
+	name    string
+	ms      *MetricSystem
+	mapping BucketMapping
+	// buckets holds the current *handleBuckets.
+	buckets atomic.Value
+	// growMu serializes growth of buckets.
+	growMu sync.Mutex
+}
+
+// Record adds a value to the histogram.
+func (h *HistogramHandle) Record(value float64) {
+	if h.mapping == nil {
+		// the histogram uses a custom HistogramBackend
+		h.ms.Histogram(h.name, value)
+		return
+	}
+	key := h.mapping.Key(value)
+	count := h.buckets.Load().(*handleBuckets).count(key)
+	if count == nil {
+		if count = h.grow(key); count == nil {
+			h.ms.shards.pick().histogram(h.name, key)
+			return
+		}
+	}
+	atomic.AddUint64(count, 1)
+}
+
+// Name returns the name of the histogram.
+func (h *HistogramHandle) Name() string {
+	return h.name
+}
+
+// peek adds the bucket counts recorded since the last collection to
+// counts, without collecting them.
+func (h *HistogramHandle) peek(counts map[int32]uint64) {
+	buckets := h.buckets.Load().(*handleBuckets)
+	for i, chunk := range buckets.chunks {
+		for j := range chunk {
+			if count := atomic.LoadUint64(&chunk[j]); count > 0 {
+				counts[int32(buckets.base+int64(i*handleChunkSize+j))] += count
+			}
+		}
+	}
+}
+
+// grow extends the buckets of the handle to cover key, returning its count,
+// or nil if that would exceed maxHandleChunks.
+func (h *HistogramHandle) grow(key int32) *uint64 {
+	h.growMu.Lock()
+	defer h.growMu.Unlock()
+	current := h.buckets.Load().(*handleBuckets)
+	if count := current.count(key); count != nil {
+		return count
+	}
+
+	// align chunks to multiples of handleChunkSize
+	keyBase := int64(key) - ((int64(key)%handleChunkSize)+
+		handleChunkSize)%handleChunkSize
+	base, end := keyBase, keyBase+handleChunkSize
+	if len(current.chunks) > 0 {
+		currentEnd := current.base + int64(len(current.chunks))*handleChunkSize
+		if current.base < base {
+			base = current.base
+		}
+		if currentEnd > end {
+			end = currentEnd
+		}
+	}
+	chunkCount := (end - base) / handleChunkSize
+	if chunkCount > maxHandleChunks {
+		return nil
+	}
+
+	next := &handleBuckets{
+		base:   base,
+		chunks: make([]*bucketChunk, chunkCount),
+	}
+	offset := (current.base - base) / handleChunkSize
+	for i, chunk := range current.chunks {
+		next.chunks[offset+int64(i)] = chunk
+	}
+	for i := range next.chunks {
+		if next.chunks[i] == nil {
+			next.chunks[i] = new(bucketChunk)
+		}
+	}
+	h.buckets.Store(next)
+	return next.count(key)
+}
+
+// NewCounterHandle returns a handle for the named Counter.  Repeated calls
+// with the same name return the same handle.
+func (ms *MetricSystem) NewCounterHandle(name string) *CounterHandle {
+	ms.handlesMu.Lock()
+	defer ms.handlesMu.Unlock()
+	h, present := ms.counterHandles[name]
+	if !present {
+		h = &CounterHandle{name: name}
+		ms.counterHandles[name] = h
+	}
+	return h
+}
+
+// NewHistogramHandle returns a handle for the named Histogram.  Repeated
+// calls with the same name return the same handle.  Any mapping or backend
+// for the histogram should be specified before the handle is created.
+func (ms *MetricSystem) NewHistogramHandle(name string) *HistogramHandle {
+	ms.handlesMu.Lock()
+	defer ms.handlesMu.Unlock()
+	h, present := ms.histogramHandles[name]
+	if !present {
+		h = &HistogramHandle{name: name, ms: ms}
+		settings := ms.loadHistogramSettings()
+		if _, custom := settings.backends[name]; !custom {
+			h.mapping = settings.mapping(name)
+		}
+		h.buckets.Store(&handleBuckets{})
+		ms.histogramHandles[name] = h
+	}
+	return h
+}
+
+// collectHandles drains every handle into the counters and histograms
+// collected from the shards.
+func (ms *MetricSystem) collectHandles(counters map[string]*uint64,
+	histograms map[string]map[int32]*uint64) {
+	ms.handlesMu.Lock()
+	defer ms.handlesMu.Unlock()
+
+	for name, h := range ms.counterHandles {
+		amount := atomic.SwapUint64(&h.count, 0)
+		if amount == 0 {
+			continue
+		}
+		if total, present := counters[name]; present {
+			*total += amount
+		} else {
+			counters[name] = &amount
+		}
+	}
+
+	for name, h := range ms.histogramHandles {
+		buckets := h.buckets.Load().(*handleBuckets)
+		for i, chunk := range buckets.chunks {
+			for j := range chunk {
+				count := atomic.SwapUint64(&chunk[j], 0)
+				if count == 0 {
+					continue
+				}
+				valuesToCounts, present := histograms[name]
+				if !present {
+					valuesToCounts = make(map[int32]*uint64)
+					histograms[name] = valuesToCounts
+				}
+				key := int32(buckets.base + int64(i*handleChunkSize+j))
+				if total, present := valuesToCounts[key]; present {
+					*total += count
+				} else {
+					valuesToCounts[key] = &count
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package loghisto
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCounterHandle(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	h := metricSystem.NewCounterHandle("requests")
+	if metricSystem.NewCounterHandle("requests") != h {
+		t.Error("expected the same handle for the same name")
+	}
+
+	h.Inc()
+	h.Add(9)
+	metricSystem.Counter("requests", 5)
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	if metrics["requests_rate"] != 15 || metrics["requests"] != 15 {
+		t.Errorf("expected a rate and total of 15, got %f and %f",
+			metrics["requests_rate"], metrics["requests"])
+	}
+
+	// the handle stays bound across the collection
+	h.Add(5)
+	metrics = metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	if metrics["requests_rate"] != 5 || metrics["requests"] != 20 {
+		t.Errorf("expected a rate of 5 and total of 20, got %f and %f",
+			metrics["requests_rate"], metrics["requests"])
+	}
+}
+
+func TestHistogramHandle(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyHistogramPrecision("latency", 10)
+	h := metricSystem.NewHistogramHandle("latency")
+	if metricSystem.NewHistogramHandle("latency") != h {
+		t.Error("expected the same handle for the same name")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// spread across chunks in both directions from the first value
+				h.Record(math.Pow(10, float64(i%8)) * float64(j+1))
+				h.Record(-1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	metricSystem.Histogram("latency", 5)
+
+	rawMetrics := metricSystem.collectRawMetrics()
+	total := uint64(0)
+	for compressedValue, count := range rawMetrics.Histograms["latency"] {
+		total += *count
+		if compressedValue != (LogMapping{Precision: 10}).Key(
+			(LogMapping{Precision: 10}).Value(compressedValue)) {
+			t.Errorf("bucket %d does not belong to the histogram's mapping",
+				compressedValue)
+		}
+	}
+	if total != 3201 {
+		t.Errorf("expected 3201 values, got %d", total)
+	}
+
+	h.Record(1e6)
+	rawMetrics = metricSystem.collectRawMetrics()
+	if len(rawMetrics.Histograms["latency"]) != 1 {
+		t.Errorf("expected only the new value after draining, got %d buckets",
+			len(rawMetrics.Histograms["latency"]))
+	}
+}
+
+func TestHistogramHandleOutOfRange(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	h := metricSystem.NewHistogramHandle("wide")
+	h.Record(1)
+	// clamped into the outermost bucket, far beyond maxHandleChunks
+	h.Record(math.Inf(1))
+
+	rawMetrics := metricSystem.collectRawMetrics()
+	if len(rawMetrics.Histograms["wide"]) != 2 {
+		t.Errorf("expected 2 buckets, got %d",
+			len(rawMetrics.Histograms["wide"]))
+	}
+}
+
+func TestHistogramHandleBackend(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyHistogramBackend("digest", func() HistogramBackend {
+		return NewTDigest(100)
+	})
+	metricSystem.NewHistogramHandle("digest").Record(3)
+	if backend := metricSystem.collectRawMetrics().Backends["digest"]; backend == nil ||
+		backend.Count() != 1 {
+		t.Error("expected the handle to record into the custom backend")
+	}
+}
+
+func BenchmarkCounterHandle(b *testing.B) {
+	h := NewMetricSystem(time.Minute, false).NewCounterHandle("c")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h.Inc()
+		}
+	})
+}
+
+func BenchmarkHistogramHandle(b *testing.B) {
+	h := NewMetricSystem(time.Minute, false).NewHistogramHandle("h")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h.Record(12345)
+		}
+	})
+}
@@ -0,0 +1,214 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import "fmt"
+
+const (
+	// OverflowMetric is the name under which counters and histograms
+	// rejected by the cardinality limit are aggregated.  Counters of both
+	// kinds are summed into a FloatCounter.
+	OverflowMetric = "loghisto.overflow"
+	// RejectedNamesMetric is a Counter of the metric names rejected by the
+	// cardinality limit, counted once for each interval they appear in.
+	RejectedNamesMetric = "loghisto.rejected_names"
+)
+
+// SetMetricTTL makes the MetricSystem forget Counters, FloatCounters and
+// Histograms that have not been updated for intervals intervals, releasing
+// their running totals.  A metric that is updated again after expiring
+// starts over from 0.  Gauges are reported at every interval, so they are
+// only removed by DeregisterGaugeFunc or RemoveGauge.  An intervals of 0,
+// the default, keeps metrics forever.  Metric names are only tracked while
+// a TTL or cardinality limit is set, so either should be set before Start.
+func (ms *MetricSystem) SetMetricTTL(intervals int) {
+	ms.namesMu.Lock()
+	ms.metricTTL = intervals
+	ms.namesMu.Unlock()
+}
+
+// SetCardinalityLimit caps the number of metric names this MetricSystem
+// tracks at once.  Once the limit is reached, values recorded under new
+// names are aggregated under OverflowMetric rather than their own name,
+// gauges with new names are not reported, and RejectedNamesMetric counts
+// the rejected names.  Names that expire through SetMetricTTL make room for
+// new ones.  A limit of 0, the default, is unlimited.
+func (ms *MetricSystem) SetCardinalityLimit(limit int) {
+	ms.namesMu.Lock()
+	ms.cardinalityLimit = limit
+	ms.namesMu.Unlock()
+}
+
+// admit marks a name as updated in the current interval, returning false
+// if it is rejected by the cardinality limit.  namesMu must be held.
+func (ms *MetricSystem) admit(name string) bool {
+	if name == OverflowMetric || name == RejectedNamesMetric {
+		// these are always reported and do not count towards the limit
+		return true
+	}
+	if _, tracked := ms.lastSeen[name]; !tracked &&
+		ms.cardinalityLimit > 0 && len(ms.lastSeen) >= ms.cardinalityLimit {
+		return false
+	}
+	ms.lastSeen[name] = ms.intervalCount
+	return true
+}
+
+// limitCardinality moves the metrics collected in an interval whose names
+// are rejected by the cardinality limit to OverflowMetric, records the
+// names of the others as updated, and forgets metrics that have expired.
+func (ms *MetricSystem) limitCardinality(counters map[string]*uint64,
+	floatCounters map[string]float64,
+	histograms map[string]map[int32]*uint64,
+	backends map[string]HistogramBackend, gauges map[string]float64) {
+	ms.namesMu.Lock()
+	ms.intervalCount++
+	if ms.cardinalityLimit == 0 && ms.metricTTL == 0 {
+		ms.namesMu.Unlock()
+		return
+	}
+
+	// refresh the names updated in this interval before expiring others, so
+	// that expired names make room for new ones
+	for name := range counters {
+		ms.refresh(name)
+	}
+	for name := range floatCounters {
+		ms.refresh(name)
+	}
+	for name := range histograms {
+		ms.refresh(name)
+	}
+	for name := range backends {
+		ms.refresh(name)
+	}
+	for name := range gauges {
+		ms.refresh(name)
+	}
+	expired := ms.expire()
+
+	// rejected counters are summed as a FloatCounter, as they may be either
+	var rejected uint64
+	var overflow float64
+	for name, count := range counters {
+		if !ms.admit(name) {
+			overflow += float64(*count)
+			delete(counters, name)
+			rejected++
+		}
+	}
+	for name, amount := range floatCounters {
+		if !ms.admit(name) {
+			overflow += amount
+			delete(floatCounters, name)
+			rejected++
+		}
+	}
+
+	settings := ms.loadHistogramSettings()
+	for name, valuesToCounts := range histograms {
+		if ms.admit(name) {
+			continue
+		}
+		mapping := settings.mapping(name)
+		delete(histograms, name)
+		rejected++
+		overflowHistogram, present := histograms[OverflowMetric]
+		if !present {
+			overflowHistogram = make(map[int32]*uint64)
+			histograms[OverflowMetric] = overflowHistogram
+		}
+		for compressedValue, count := range valuesToCounts {
+			// the overflow histogram always uses DefaultMapping
+			key := DefaultMapping.Key(mapping.Value(compressedValue))
+			if total, present := overflowHistogram[key]; present {
+				*total += *count
+			} else {
+				overflowHistogram[key] = count
+			}
+		}
+	}
+	for name := range backends {
+		if !ms.admit(name) {
+			delete(backends, name)
+			rejected++
+		}
+	}
+	for name := range gauges {
+		if !ms.admit(name) {
+			delete(gauges, name)
+			rejected++
+		}
+	}
+
+	if rejected > 0 {
+		floatCounters[OverflowMetric] += overflow
+	}
+	if ms.cardinalityLimit > 0 {
+		// report 0 as well, so that the self-metric exists once enabled
+		counters[RejectedNamesMetric] = &rejected
+	}
+	ms.namesMu.Unlock()
+
+	ms.forget(expired)
+}
+
+// refresh marks a tracked name as updated in the current interval.
+// namesMu must be held.
+func (ms *MetricSystem) refresh(name string) {
+	if _, tracked := ms.lastSeen[name]; tracked {
+		ms.lastSeen[name] = ms.intervalCount
+	}
+}
+
+// expire stops tracking the names that have not been updated for the
+// configured TTL, and returns them.  namesMu must be held.
+func (ms *MetricSystem) expire() []string {
+	if ms.metricTTL == 0 {
+		return nil
+	}
+	var expired []string
+	for name, seen := range ms.lastSeen {
+		if ms.intervalCount-seen >= uint64(ms.metricTTL) {
+			expired = append(expired, name)
+			delete(ms.lastSeen, name)
+		}
+	}
+	return expired
+}
+
+// forget releases the running totals of expired metrics.
+func (ms *MetricSystem) forget(expired []string) {
+	if len(expired) == 0 {
+		return
+	}
+
+	ms.counterStoreMu.Lock()
+	for _, name := range expired {
+		delete(ms.counterStore, name)
+		delete(ms.floatCounterStore, name)
+	}
+	ms.counterStoreMu.Unlock()
+
+	ms.histogramCountMu.Lock()
+	for _, name := range expired {
+		delete(ms.histogramCountStore, fmt.Sprintf("%s_sum", name))
+		delete(ms.histogramCountStore, fmt.Sprintf("%s_count", name))
+	}
+	ms.histogramCountMu.Unlock()
+}
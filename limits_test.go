@@ -0,0 +1,113 @@
+package loghisto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCardinalityLimit(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetCardinalityLimit(3)
+	metricSystem.Counter("a", 1)
+	metricSystem.Counter("b", 1)
+	metricSystem.Histogram("h", 10)
+	rawMetrics := metricSystem.collectRawMetrics()
+	if rawMetrics.Rates["a"] != 1 || rawMetrics.Rates["b"] != 1 ||
+		len(rawMetrics.Histograms["h"]) != 1 {
+		t.Errorf("expected names within the limit to be reported, got %v",
+			rawMetrics)
+	}
+	if rawMetrics.Counters[RejectedNamesMetric] != 0 {
+		t.Errorf("expected no rejected names, got %d",
+			rawMetrics.Counters[RejectedNamesMetric])
+	}
+
+	metricSystem.Counter("a", 1)
+	metricSystem.Counter("c", 5)
+	metricSystem.FloatCounter("f", .5)
+	metricSystem.Histogram("h2", 10)
+	metricSystem.Histogram("h2", 20)
+	metricSystem.RegisterGaugeFunc("g", func() float64 { return 1 })
+	rawMetrics = metricSystem.collectRawMetrics()
+	if rawMetrics.Counters["a"] != 2 {
+		t.Errorf("expected a tracked name to keep counting, got %d",
+			rawMetrics.Counters["a"])
+	}
+	if _, present := rawMetrics.Counters["c"]; present {
+		t.Error("expected counter c to be rejected")
+	}
+	if _, present := rawMetrics.Histograms["h2"]; present {
+		t.Error("expected histogram h2 to be rejected")
+	}
+	if _, present := rawMetrics.Gauges["g"]; present {
+		t.Error("expected gauge g to be rejected")
+	}
+	if rawMetrics.FloatRates[OverflowMetric] != 5.5 {
+		t.Errorf("expected overflow of 5.5, got %f",
+			rawMetrics.FloatRates[OverflowMetric])
+	}
+	overflowCount := uint64(0)
+	for _, count := range rawMetrics.Histograms[OverflowMetric] {
+		overflowCount += *count
+	}
+	if overflowCount != 2 {
+		t.Errorf("expected 2 overflow histogram values, got %d", overflowCount)
+	}
+	if rawMetrics.Counters[RejectedNamesMetric] != 4 {
+		t.Errorf("expected 4 rejected names, got %d",
+			rawMetrics.Counters[RejectedNamesMetric])
+	}
+}
+
+func TestMetricTTL(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetMetricTTL(2)
+	metricSystem.SetCardinalityLimit(2)
+	metricSystem.Counter("a", 3)
+	metricSystem.Histogram("h", 1)
+	metricSystem.processMetrics(metricSystem.collectRawMetrics())
+
+	if _, present := metricSystem.collectRawMetrics().Counters["a"]; !present {
+		t.Error("expected counter a to be kept for 2 intervals")
+	}
+
+	metricSystem.Counter("b", 1)
+	metricSystem.Counter("c", 1)
+	rawMetrics := metricSystem.collectRawMetrics()
+	if _, present := rawMetrics.Counters["a"]; present {
+		t.Error("expected counter a to expire")
+	}
+	if rawMetrics.Counters["b"] != 1 || rawMetrics.Counters["c"] != 1 {
+		t.Errorf("expected counters b and c to take the expired slots, got %v",
+			rawMetrics.Counters)
+	}
+	metricSystem.histogramCountMu.RLock()
+	if _, present := metricSystem.histogramCountStore["h_sum"]; present {
+		t.Error("expected the aggregate sum of histogram h to expire")
+	}
+	metricSystem.histogramCountMu.RUnlock()
+
+	metricSystem.Counter("a", 1)
+	metricSystem.Counter("b", 1)
+	rawMetrics = metricSystem.collectRawMetrics()
+	if _, present := rawMetrics.Counters["a"]; present {
+		t.Error("expected counter a to be rejected while b and c hold the slots")
+	}
+	if rawMetrics.Counters["b"] != 2 {
+		t.Errorf("expected counter b to keep counting, got %d",
+			rawMetrics.Counters["b"])
+	}
+}
+
+func TestUntrackedNames(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.Counter("a", 1)
+	rawMetrics := metricSystem.collectRawMetrics()
+	if _, present := rawMetrics.Counters[RejectedNamesMetric]; present {
+		t.Error("expected no self-metric without a cardinality limit")
+	}
+	if len(metricSystem.lastSeen) != 0 {
+		t.Errorf("expected no names to be tracked, got %v",
+			metricSystem.lastSeen)
+	}
+}
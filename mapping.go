@@ -0,0 +1,336 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"fmt"
+	"math"
+)
+
+// BucketMapping converts histogram values to and from the bucket keys used
+// by RawMetricSet.Histograms.  Every value that falls into a bucket is
+// reported as the representative value of that bucket.
+type BucketMapping interface {
+	// Key returns the bucket that value falls into.  Values beyond
+	// MaxValue are clamped into the outermost bucket.
+	Key(value float64) int32
+	// Value returns the representative value of a bucket.
+	Value(key int32) float64
+	// Bounds returns the lowest and highest values that fall into a bucket.
+	Bounds(key int32) (lower, upper float64)
+	// RelativeError is the largest relative difference between a value
+	// and the representative value of its bucket, within the range where
+	// the mapping guarantees one.
+	RelativeError() float64
+	// MaxValue is the largest magnitude that is bucketed without clamping.
+	MaxValue() float64
+	// String describes the mapping, including its range and error bound.
+	String() string
+}
+
+// LogMapping is the classic loghisto bucketing scheme: a value v is stored
+// in bucket round(Precision * ln(1 + |v|)), negated for negative values.
+// Buckets are spaced evenly in ln(1 + |v|), so for values much larger than
+// 1 the relative error is at most e^(0.5/Precision) - 1, or about
+// 0.5/Precision.  Values closer to 0 than about Precision/100 only keep an
+// absolute error of about 0.5/Precision.  Precision must be finite and
+// positive.
+type LogMapping struct {
+	Precision float64
+}
+
+// defaultPrecision is the Precision of DefaultMapping.
+const defaultPrecision = 100
+
+// DefaultMapping is used for histograms without a mapping of their own,
+// and keeps large values within about 0.5% of their true value.
+var DefaultMapping BucketMapping = LogMapping{Precision: defaultPrecision}
+
+// Key implements BucketMapping.
+func (m LogMapping) Key(value float64) int32 {
+	f := m.Precision*math.Log1p(math.Abs(value)) + 0.5
+	if f > math.MaxInt32 || math.IsNaN(f) {
+		f = math.MaxInt32
+	}
+	if value < 0 {
+		return -int32(f)
+	}
+	return int32(f)
+}
+
+// Value implements BucketMapping.
+func (m LogMapping) Value(key int32) float64 {
+	f := math.Expm1(math.Abs(float64(key)) / m.Precision)
+	if key < 0 {
+		return -f
+	}
+	return f
+}
+
+// Bounds implements BucketMapping.
+func (m LogMapping) Bounds(key int32) (lower, upper float64) {
+	k := math.Abs(float64(key))
+	lower = math.Expm1(math.Max(k-0.5, 0) / m.Precision)
+	upper = math.Expm1((k + 0.5) / m.Precision)
+	if key == 0 {
+		// small values of either sign round to key 0
+		return -upper, upper
+	}
+	if key < 0 {
+		return -upper, -lower
+	}
+	return lower, upper
+}
+
+// RelativeError implements BucketMapping.
+func (m LogMapping) RelativeError() float64 {
+	return math.Expm1(0.5 / m.Precision)
+}
+
+// MaxValue implements BucketMapping.
+func (m LogMapping) MaxValue() float64 {
+	return math.Expm1(math.MaxInt32 / m.Precision)
+}
+
+func (m LogMapping) String() string {
+	return fmt.Sprintf("log(precision=%g, relative error=%.3g%%, max=%g)",
+		m.Precision, 100*m.RelativeError(), m.MaxValue())
+}
+
+// SpecifyHistogramMapping overrides the BucketMapping used for the named
+// histogram, which should be done before any values are recorded under
+// that name.  It panics if mapping is a LogMapping whose Precision is not
+// finite and positive.
+func (ms *MetricSystem) SpecifyHistogramMapping(name string,
+	mapping BucketMapping) {
+	if m, ok := mapping.(LogMapping); ok &&
+		!(m.Precision > 0 && !math.IsInf(m.Precision, 1)) {
+		panic(fmt.Sprintf("precision %g is not finite and positive",
+			m.Precision))
+	}
+	ms.updateHistogramSettings(func(settings *histogramSettings) {
+		settings.mappings[name] = mapping
+	})
+}
+
+// SpecifyHistogramPrecision uses a LogMapping with the given precision for
+// the named histogram.  Coarse precisions, such as 10 for byte sizes,
+// produce fewer buckets, while finer ones, such as 1000 for latencies,
+// reduce the error of reported percentiles.  It panics unless precision is
+// finite and positive.
+func (ms *MetricSystem) SpecifyHistogramPrecision(name string,
+	precision float64) {
+	ms.SpecifyHistogramMapping(name, LogMapping{Precision: precision})
+}
+
+// Mapping returns the BucketMapping used for the keys of the named
+// histogram in this RawMetricSet.
+func (rawMetrics *RawMetricSet) Mapping(name string) BucketMapping {
+	mapping, present := rawMetrics.Mappings[name]
+	if !present {
+		return DefaultMapping
+	}
+	return mapping
+}
+
+// RelativeMapping is a DDSketch-style logarithmic bucketing scheme that
+// guarantees a relative error for every value whose magnitude is at least
+// MinValue, including fractions, ratios and probabilities far below 1.
+//
+// Its keys are split into three stores: key 0 holds values closer to 0
+// than MinValue, positive keys hold positive values and negative keys hold
+// negative values.  Within each signed store, key k holds magnitudes in
+// (gamma^(i-1), gamma^i] where i = k + minIndex - 1, gamma is
+// (1 + RelativeAccuracy) / (1 - RelativeAccuracy), and minIndex is the
+// index of MinValue.  The zero value uses DefaultRelativeAccuracy and
+// DefaultMinValue.
+type RelativeMapping struct {
+	relativeAccuracy float64
+	minValue         float64
+	logGamma         float64
+	minIndex         float64
+}
+
+const (
+	// DefaultMinValue is the smallest magnitude distinguished from 0 by
+	// NewRelativeMapping when a minimum value of 0 is requested.
+	DefaultMinValue = 1e-9
+	// DefaultRelativeAccuracy is the relative accuracy of the zero value of
+	// RelativeMapping.
+	DefaultRelativeAccuracy = .01
+)
+
+// defaultRelativeMapping stands in for the zero value of RelativeMapping.
+var defaultRelativeMapping = NewRelativeMapping(DefaultRelativeAccuracy,
+	DefaultMinValue)
+
+// NewRelativeMapping creates a RelativeMapping that reports every value
+// whose magnitude is at least minValue within relativeAccuracy of its
+// true value.  relativeAccuracy must be within (0, 1), for example .01 for
+// 1% accuracy, and NewRelativeMapping panics otherwise.  A minValue of 0
+// uses DefaultMinValue.
+func NewRelativeMapping(relativeAccuracy, minValue float64) RelativeMapping {
+	if !(relativeAccuracy > 0 && relativeAccuracy < 1) {
+		panic(fmt.Sprintf("relative accuracy %g is not within (0, 1)",
+			relativeAccuracy))
+	}
+	if minValue <= 0 {
+		minValue = DefaultMinValue
+	}
+	logGamma := math.Log((1 + relativeAccuracy) / (1 - relativeAccuracy))
+	return RelativeMapping{
+		relativeAccuracy: relativeAccuracy,
+		minValue:         minValue,
+		logGamma:         logGamma,
+		minIndex:         math.Ceil(math.Log(minValue) / logGamma),
+	}
+}
+
+// orDefault returns defaultRelativeMapping in place of the zero value.
+func (m RelativeMapping) orDefault() RelativeMapping {
+	if m.logGamma == 0 {
+		return defaultRelativeMapping
+	}
+	return m
+}
+
+// Key implements BucketMapping.
+func (m RelativeMapping) Key(value float64) int32 {
+	m = m.orDefault()
+	magnitude := math.Abs(value)
+	if magnitude < m.minValue || math.IsNaN(value) {
+		return 0
+	}
+	f := math.Ceil(math.Log(magnitude)/m.logGamma) - m.minIndex + 1
+	if f > math.MaxInt32 {
+		f = math.MaxInt32
+	}
+	if value < 0 {
+		return -int32(f)
+	}
+	return int32(f)
+}
+
+// Value implements BucketMapping.
+func (m RelativeMapping) Value(key int32) float64 {
+	m = m.orDefault()
+	if key == 0 {
+		return 0
+	}
+	index := math.Abs(float64(key)) + m.minIndex - 1
+	// the point of (gamma^(index-1), gamma^index] with equal relative
+	// distance to both ends
+	f := 2 * math.Exp(index*m.logGamma) / (1 + math.Exp(m.logGamma))
+	if key < 0 {
+		return -f
+	}
+	return f
+}
+
+// Bounds implements BucketMapping.
+func (m RelativeMapping) Bounds(key int32) (lower, upper float64) {
+	m = m.orDefault()
+	if key == 0 {
+		return -m.minValue, m.minValue
+	}
+	index := math.Abs(float64(key)) + m.minIndex - 1
+	lower = math.Exp((index - 1) * m.logGamma)
+	upper = math.Exp(index * m.logGamma)
+	if key < 0 {
+		return -upper, -lower
+	}
+	return lower, upper
+}
+
+// RelativeError implements BucketMapping.  The bound holds for all values
+// whose magnitude is at least MinValue.
+func (m RelativeMapping) RelativeError() float64 {
+	m = m.orDefault()
+	return m.relativeAccuracy
+}
+
+// MaxValue implements BucketMapping.
+func (m RelativeMapping) MaxValue() float64 {
+	m = m.orDefault()
+	return math.Exp((math.MaxInt32 + m.minIndex - 1) * m.logGamma)
+}
+
+// MinValue is the smallest magnitude that is not reported as 0.
+func (m RelativeMapping) MinValue() float64 {
+	m = m.orDefault()
+	return m.minValue
+}
+
+func (m RelativeMapping) String() string {
+	m = m.orDefault()
+	return fmt.Sprintf("relative(relative error=%.3g%%, min=%g, max=%g)",
+		100*m.relativeAccuracy, m.minValue, m.MaxValue())
+}
+
+// SpecifyHistogramRelativeAccuracy uses a RelativeMapping with the given
+// relative accuracy and DefaultMinValue for the named histogram, so that
+// sub-unit values such as ratios and fractions of a second are reported
+// as accurately as large ones.  It panics unless relativeAccuracy is within
+// (0, 1).
+func (ms *MetricSystem) SpecifyHistogramRelativeAccuracy(name string,
+	relativeAccuracy float64) {
+	ms.SpecifyHistogramMapping(name,
+		NewRelativeMapping(relativeAccuracy, DefaultMinValue))
+}
+
+// PercentileErrors selects companion outputs that describe how far each
+// reported percentile may be from the true one.  Flags may be combined.
+type PercentileErrors int
+
+const (
+	// PercentileBounds adds <percentile>_lower and <percentile>_upper, the
+	// bounds of the bucket the percentile fell into, between which the true
+	// percentile is guaranteed to lie.
+	PercentileBounds PercentileErrors = 1 << iota
+	// PercentileRelativeError adds <percentile>_rel_error, the largest
+	// relative distance from the reported percentile to the bounds of its
+	// bucket.  It is omitted for percentiles reported as 0.
+	PercentileRelativeError
+)
+
+// SpecifyPercentileErrors selects the companion outputs reported alongside
+// each percentile of histograms that use a BucketMapping, for example
+// foo_99_lower and foo_99_upper so that "p99 is between X and Y" may be
+// stated.  Pass 0 to disable them, which is the default.
+func (ms *MetricSystem) SpecifyPercentileErrors(errors PercentileErrors) {
+	ms.percentileErrors = errors
+}
+
+// reportPercentileErrors adds the companion outputs selected by
+// SpecifyPercentileErrors for a percentile to output.
+func (ms *MetricSystem) reportPercentileErrors(percentileName string,
+	p proportion, mapping BucketMapping, output map[string]float64) {
+	if ms.percentileErrors == 0 {
+		return
+	}
+	lower, upper := mapping.Bounds(p.Key)
+	if ms.percentileErrors&PercentileBounds != 0 {
+		output[percentileName+"_lower"] = lower
+		output[percentileName+"_upper"] = upper
+	}
+	if ms.percentileErrors&PercentileRelativeError != 0 && p.Value != 0 {
+		output[percentileName+"_rel_error"] = math.Max(
+			math.Abs(p.Value-lower), math.Abs(upper-p.Value)) /
+			math.Abs(p.Value)
+	}
+}
@@ -0,0 +1,241 @@
+package loghisto
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLogMappingRelativeError(t *testing.T) {
+	for _, precision := range []float64{10, 100, 1000} {
+		mapping := LogMapping{Precision: precision}
+		bound := mapping.RelativeError()
+		for _, f := range []float64{
+			-1e300, -2.5e142, -1e9, -1e3, 1e3, 1e9, 2.5e142, 1e300,
+		} {
+			result := mapping.Value(mapping.Key(f))
+			if diff := math.Abs(f/result - 1); diff > bound {
+				t.Errorf("%s: expected: %g, actual: %g, %% off: %.04f",
+					mapping, f, result, diff*100)
+			}
+		}
+	}
+}
+
+func TestLogMappingRange(t *testing.T) {
+	mapping := LogMapping{Precision: 100}
+	if !math.IsInf(mapping.MaxValue(), 1) {
+		t.Errorf("expected precision 100 to cover every float64, max was %g",
+			mapping.MaxValue())
+	}
+	if key := mapping.Key(math.Inf(1)); key != math.MaxInt32 {
+		t.Errorf("expected +Inf to clamp to the outermost bucket, got %d", key)
+	}
+	if key := mapping.Key(math.Inf(-1)); key != -math.MaxInt32 {
+		t.Errorf("expected -Inf to clamp to the outermost bucket, got %d", key)
+	}
+}
+
+func TestSpecifyHistogramPrecision(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyHistogramPrecision("bytes", 10)
+	for _, value := range []float64{1000, 1010, 1020, 1030} {
+		metricSystem.Histogram("bytes", value)
+		metricSystem.Histogram("latency", value)
+	}
+	rawMetrics := metricSystem.collectRawMetrics()
+
+	if len(rawMetrics.Histograms["bytes"]) != 1 {
+		t.Errorf("expected coarse precision to use 1 bucket, got %d",
+			len(rawMetrics.Histograms["bytes"]))
+	}
+	if len(rawMetrics.Histograms["latency"]) != 4 {
+		t.Errorf("expected default precision to use 4 buckets, got %d",
+			len(rawMetrics.Histograms["latency"]))
+	}
+	if rawMetrics.Mapping("bytes") != (LogMapping{Precision: 10}) {
+		t.Errorf("expected bytes mapping to be exported, got %s",
+			rawMetrics.Mapping("bytes"))
+	}
+	if rawMetrics.Mapping("latency") != DefaultMapping {
+		t.Errorf("expected latency to use the default mapping, got %s",
+			rawMetrics.Mapping("latency"))
+	}
+
+	metrics := metricSystem.processMetrics(rawMetrics).Metrics
+	if diff := math.Abs(metrics["bytes_max"]/1030 - 1); diff > .05 {
+		t.Errorf("expected bytes_max within 5%% of 1030, got %f",
+			metrics["bytes_max"])
+	}
+}
+
+func TestRelativeMapping(t *testing.T) {
+	mapping := NewRelativeMapping(.01, 1e-9)
+	for _, f := range []float64{
+		-1e300, -42, -0.5, -1e-6, 1e-9, 1e-6, 0.001, 0.013, 0.25, 0.5, 0.99,
+		1, 1.5, 42, 1e9, 1e300,
+	} {
+		result := mapping.Value(mapping.Key(f))
+		// values on a bucket boundary are exactly RelativeError away
+		diff := math.Abs(result/f - 1)
+		if diff > mapping.RelativeError()+1e-12 {
+			t.Errorf("%s: expected: %g, actual: %g, %% off: %.04f",
+				mapping, f, result, diff*100)
+		}
+	}
+
+	if mapping.Key(0) != 0 || mapping.Key(1e-10) != 0 || mapping.Key(-1e-10) != 0 {
+		t.Error("expected values closer to 0 than MinValue in the zero bucket")
+	}
+	if mapping.Key(1e-9) <= 0 || mapping.Key(-1e-9) >= 0 {
+		t.Error("expected positive and negative values in separate stores")
+	}
+	if mapping.Key(0.1) == mapping.Key(0.2) {
+		t.Error("expected sub-unit values to land in distinct buckets")
+	}
+	if !math.IsInf(mapping.MaxValue(), 1) {
+		t.Errorf("expected every float64 to be covered, max was %g",
+			mapping.MaxValue())
+	}
+}
+
+func TestInvalidPrecision(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	for _, precision := range []float64{0, -10, math.NaN(), math.Inf(1)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected precision %g to panic", precision)
+				}
+			}()
+			metricSystem.SpecifyHistogramPrecision("p", precision)
+		}()
+	}
+	if metricSystem.loadHistogramSettings().mapping("p") != DefaultMapping {
+		t.Error("expected invalid precisions to leave the mapping unchanged")
+	}
+}
+
+func TestInvalidRelativeMapping(t *testing.T) {
+	for _, accuracy := range []float64{0, 1, -.5, 2, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected relative accuracy %g to panic", accuracy)
+				}
+			}()
+			NewRelativeMapping(accuracy, 0)
+		}()
+	}
+
+	// the zero value uses the defaults
+	var mapping RelativeMapping
+	if mapping.RelativeError() != DefaultRelativeAccuracy ||
+		mapping.MinValue() != DefaultMinValue {
+		t.Errorf("expected the zero value to use the defaults, got %s", mapping)
+	}
+	if key := mapping.Key(5); key == math.MaxInt32 || key == 1 ||
+		mapping.Key(6) == key {
+		t.Errorf("expected the zero value to bucket values, got key %d", key)
+	}
+	if diff := math.Abs(mapping.Value(mapping.Key(5))/5 - 1); diff >
+		DefaultRelativeAccuracy+1e-12 {
+		t.Errorf("expected 5 within the default accuracy, got %g",
+			mapping.Value(mapping.Key(5)))
+	}
+}
+
+func TestSpecifyHistogramRelativeAccuracy(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyHistogramRelativeAccuracy("ratio", .01)
+	for i := 1; i <= 100; i++ {
+		metricSystem.Histogram("ratio", float64(i)/1000)
+	}
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+
+	for name, expected := range map[string]float64{
+		"ratio_min": 0.001,
+		"ratio_50":  0.05,
+		"ratio_max": 0.1,
+	} {
+		if diff := math.Abs(metrics[name]/expected - 1); diff > .01 {
+			t.Errorf("expected %s within 1%% of %g, got %g", name, expected,
+				metrics[name])
+		}
+	}
+}
+
+func TestMappingBounds(t *testing.T) {
+	for _, mapping := range []BucketMapping{
+		LogMapping{Precision: 100},
+		LogMapping{Precision: 7},
+		NewRelativeMapping(.02, 1e-6),
+		NewHDRMapping(2),
+	} {
+		for _, f := range []float64{
+			-1e12, -4097, -3.5, -1, -0.3, -0.004, -1e-7, 0, 1e-5, 0.3, 1, 2,
+			3.5, 255, 4097, 1e12,
+		} {
+			key := mapping.Key(f)
+			lower, upper := mapping.Bounds(key)
+			if f < lower || f > upper {
+				t.Errorf("%s: %g fell outside of its bucket [%g, %g]", mapping,
+					f, lower, upper)
+			}
+			if value := mapping.Value(key); value < lower || value > upper {
+				t.Errorf("%s: representative value %g is outside of [%g, %g]",
+					mapping, value, lower, upper)
+			}
+		}
+	}
+}
+
+func TestZeroBucketBounds(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyPercentiles(map[string]float64{"%s_50": .5})
+	metricSystem.SpecifyPercentileErrors(PercentileBounds)
+	metricSystem.InterpolatePercentiles(true)
+	metricSystem.SpecifyHistogramMapping("hdr", NewHDRMapping(2))
+	for _, name := range []string{"log", "hdr"} {
+		for i := 0; i < 3; i++ {
+			metricSystem.Histogram(name, -0.004)
+		}
+	}
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+
+	for _, name := range []string{"log", "hdr"} {
+		p50, lower, upper := metrics[name+"_50"], metrics[name+"_50_lower"],
+			metrics[name+"_50_upper"]
+		if !(lower <= -0.004 && -0.004 <= upper) {
+			t.Errorf("%s: expected -0.004 within [%f, %f]", name, lower, upper)
+		}
+		if !(lower <= p50 && p50 <= upper) {
+			t.Errorf("%s: expected %f within [%f, %f]", name, p50, lower, upper)
+		}
+	}
+}
+
+func TestSpecifyPercentileErrors(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyPercentiles(map[string]float64{"%s_99": .99})
+	metricSystem.SpecifyPercentileErrors(
+		PercentileBounds | PercentileRelativeError)
+	for i := 1; i <= 100; i++ {
+		metricSystem.Histogram("latency", float64(i*1000))
+	}
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+
+	p99, lower, upper := metrics["latency_99"], metrics["latency_99_lower"],
+		metrics["latency_99_upper"]
+	if !(lower <= 99000 && 99000 <= upper) || !(lower <= p99 && p99 <= upper) {
+		t.Errorf("expected 99000 and %f within [%f, %f]", p99, lower, upper)
+	}
+	relError := metrics["latency_99_rel_error"]
+	if relError <= 0 || relError > DefaultMapping.RelativeError()*1.01 {
+		t.Errorf("expected a relative error within the mapping's bound, got %f",
+			relError)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// ewma is an exponentially weighted moving average of a per-second rate,
+// updated once per interval.
+type ewma struct {
+	// window is the time constant of the decay.
+	window      time.Duration
+	rate        float64
+	initialized bool
+}
+
+// newEWMA creates an ewma that decays with a time constant of window.
+func newEWMA(window time.Duration) ewma {
+	return ewma{window: window}
+}
+
+// update folds the per-second rate of the latest elapsed period into the
+// average, weighting it by the length of the period.
+func (e *ewma) update(rate float64, elapsed time.Duration) {
+	if !e.initialized {
+		e.rate = rate
+		e.initialized = true
+		return
+	}
+	alpha := 1 - math.Exp(-elapsed.Seconds()/e.window.Seconds())
+	e.rate += alpha * (rate - e.rate)
+}
+
+// Meter measures the rate of events, such as requests, in events per
+// second.  At each interval it reports <name>_m1_rate, <name>_m5_rate and
+// <name>_m15_rate, the 1, 5 and 15 minute exponentially weighted moving
+// averages of the rate, and <name>_mean_rate, the mean rate since the
+// Meter was created, in RawMetricSet.Gauges.
+type Meter struct {
+	name string
+	// uncounted holds the events marked since the last interval.
+	uncounted uint64
+	// the following are only accessed by reaper().
+	count       uint64
+	start       time.Time
+	lastTick    time.Time
+	m1, m5, m15 ewma
+	interval    time.Duration
+}
+
+// Mark records n events.
+func (m *Meter) Mark(n uint64) {
+	atomic.AddUint64(&m.uncounted, n)
+}
+
+// Name returns the name of the meter.
+func (m *Meter) Name() string {
+	return m.name
+}
+
+// tick folds the events of the latest interval into the rates of the meter
+// and adds them to gauges.
+func (m *Meter) tick(now time.Time, gauges map[string]float64) {
+	count := atomic.SwapUint64(&m.uncounted, 0)
+	m.count += count
+	// the first interval of a meter is usually only partly covered
+	elapsed := now.Sub(m.lastTick)
+	if elapsed <= 0 {
+		elapsed = m.interval
+	}
+	m.lastTick = now
+	rate := float64(count) / elapsed.Seconds()
+	m.m1.update(rate, elapsed)
+	m.m5.update(rate, elapsed)
+	m.m15.update(rate, elapsed)
+
+	gauges[fmt.Sprintf("%s_m1_rate", m.name)] = m.m1.rate
+	gauges[fmt.Sprintf("%s_m5_rate", m.name)] = m.m5.rate
+	gauges[fmt.Sprintf("%s_m15_rate", m.name)] = m.m15.rate
+	if elapsed := now.Sub(m.start).Seconds(); elapsed > 0 {
+		gauges[fmt.Sprintf("%s_mean_rate", m.name)] = float64(m.count) / elapsed
+	}
+}
+
+// NewMeter returns the named Meter, creating it if it does not exist yet.
+func (ms *MetricSystem) NewMeter(name string) *Meter {
+	ms.metersMu.Lock()
+	defer ms.metersMu.Unlock()
+	m, present := ms.meters[name]
+	if !present {
+		now := ms.clock.Now()
+		m = &Meter{
+			name:     name,
+			start:    now,
+			lastTick: now,
+			m1:       newEWMA(time.Minute),
+			m5:       newEWMA(5 * time.Minute),
+			m15:      newEWMA(15 * time.Minute),
+			interval: ms.interval,
+		}
+		ms.meters[name] = m
+	}
+	return m
+}
+
+// collectMeters ticks every Meter, adding their rates to gauges.
+func (ms *MetricSystem) collectMeters(now time.Time,
+	gauges map[string]float64) {
+	ms.metersMu.Lock()
+	defer ms.metersMu.Unlock()
+	for _, m := range ms.meters {
+		m.tick(now, gauges)
+	}
+}
+
+// NormalizeRates selects whether the <name>_rate outputs of counters are
+// reported per second rather than per interval, so that they keep their
+// meaning if the interval changes.  It should be called before NewRollup,
+// whose tiers inherit the setting.
+func (ms *MetricSystem) NormalizeRates(normalize bool) {
+	ms.normalizeRates = normalize
+}
+
+// rateScale returns the factor applied to the count of a counter during an
+// interval to produce its <name>_rate output.
+func (ms *MetricSystem) rateScale() float64 {
+	if !ms.normalizeRates {
+		return 1
+	}
+	return 1 / ms.interval.Seconds()
+}
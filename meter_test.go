@@ -0,0 +1,98 @@
+package loghisto
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/spacejam/loghisto/clocktest"
+)
+
+func TestMeter(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(0, 0))
+	metricSystem := NewMetricSystem(10*time.Second, false)
+	metricSystem.SetClock(clock)
+	m := metricSystem.NewMeter("requests")
+	if metricSystem.NewMeter("requests") != m {
+		t.Error("expected the same meter for the same name")
+	}
+
+	// 100 events per second for the first interval
+	m.Mark(1000)
+	clock.Advance(10 * time.Second)
+	gauges := metricSystem.collectRawMetrics().Gauges
+	for _, output := range []string{"requests_m1_rate", "requests_m5_rate",
+		"requests_m15_rate", "requests_mean_rate"} {
+		if gauges[output] != 100 {
+			t.Errorf("expected %s of 100, got %f", output, gauges[output])
+		}
+	}
+
+	// then none for the second
+	clock.Advance(10 * time.Second)
+	gauges = metricSystem.collectRawMetrics().Gauges
+	if gauges["requests_mean_rate"] != 50 {
+		t.Errorf("expected mean rate of 50, got %f",
+			gauges["requests_mean_rate"])
+	}
+	expected := 100 * math.Exp(-10.0/60)
+	if math.Abs(gauges["requests_m1_rate"]-expected) > 1e-9 {
+		t.Errorf("expected 1 minute rate of %f, got %f", expected,
+			gauges["requests_m1_rate"])
+	}
+	if !(gauges["requests_m1_rate"] < gauges["requests_m5_rate"] &&
+		gauges["requests_m5_rate"] < gauges["requests_m15_rate"]) {
+		t.Errorf("expected longer windows to decay more slowly, got %v",
+			gauges)
+	}
+}
+
+func TestMeterPartialInterval(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(0, 0))
+	metricSystem := NewMetricSystem(10*time.Second, false)
+	metricSystem.SetClock(clock)
+
+	// the meter is created halfway through an interval
+	clock.Advance(5 * time.Second)
+	m := metricSystem.NewMeter("requests")
+	m.Mark(500)
+	clock.Advance(5 * time.Second)
+	gauges := metricSystem.collectRawMetrics().Gauges
+	if gauges["requests_m1_rate"] != 100 {
+		t.Errorf("expected a first rate of 100, got %f",
+			gauges["requests_m1_rate"])
+	}
+
+	m.Mark(1000)
+	clock.Advance(10 * time.Second)
+	gauges = metricSystem.collectRawMetrics().Gauges
+	if gauges["requests_m1_rate"] != 100 ||
+		gauges["requests_mean_rate"] != 100 {
+		t.Errorf("expected steady rates of 100, got %v", gauges)
+	}
+}
+
+func TestNormalizeRates(t *testing.T) {
+	metricSystem := NewMetricSystem(10*time.Second, false)
+	metricSystem.Counter("c", 50)
+	metricSystem.FloatCounter("f", 5)
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	if metrics["c_rate"] != 50 || metrics["f_rate"] != 5 {
+		t.Errorf("expected rates per interval of 50 and 5, got %f and %f",
+			metrics["c_rate"], metrics["f_rate"])
+	}
+
+	metricSystem.NormalizeRates(true)
+	metricSystem.Counter("c", 50)
+	metricSystem.FloatCounter("f", 5)
+	metrics = metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	if metrics["c_rate"] != 5 || metrics["f_rate"] != .5 {
+		t.Errorf("expected rates per second of 5 and .5, got %f and %f",
+			metrics["c_rate"], metrics["f_rate"])
+	}
+	if metrics["c"] != 100 {
+		t.Errorf("expected an unnormalized total of 100, got %f", metrics["c"])
+	}
+}
@@ -37,26 +37,49 @@ import (
 	"github.com/golang/glog"
 )
 
-const (
-	// precision effects the bucketing used during histogram value compression.
-	precision = 100
-)
-
 // ProcessedMetricSet contains human-readable metrics that may also be
 // suitable for storage in time-series databases.
 type ProcessedMetricSet struct {
 	Time    time.Time
 	Metrics map[string]float64
+	// Metadata describes the outputs of registered metrics, keyed by the
+	// output's name in Metrics.
+	Metadata map[string]MetricMetadata
+	// Exemplars holds an example value from the bucket of each percentile
+	// of a histogram recorded with exemplars, keyed by the percentile's
+	// name in Metrics.
+	Exemplars map[string]Exemplar
+	// exemplarHistograms holds the buckets of each histogram recorded with
+	// exemplars, for OpenMetricsProtocol.
+	exemplarHistograms map[string]*exemplarHistogram
 }
 
 // RawMetricSet contains metrics in a form that supports generation of
 // percentiles and other rich statistics.
 type RawMetricSet struct {
-	Time       time.Time
-	Counters   map[string]uint64
-	Rates      map[string]uint64
-	Histograms map[string]map[int16]*uint64
-	Gauges     map[string]float64
+	Time     time.Time
+	Counters map[string]uint64
+	Rates    map[string]uint64
+	// FloatCounters and FloatRates hold the totals and rates of counters
+	// recorded with FloatCounter.
+	FloatCounters map[string]float64
+	FloatRates    map[string]float64
+	Histograms    map[string]map[int32]*uint64
+	// Mappings holds the BucketMapping of each histogram that does not use
+	// DefaultMapping.
+	Mappings map[string]BucketMapping
+	// Backends holds histograms that use a custom HistogramBackend.
+	Backends map[string]HistogramBackend
+	Gauges   map[string]float64
+	// Exemplars holds the most recent Exemplar of each bucket of the
+	// histograms recorded with HistogramWithExemplar.
+	Exemplars map[string]map[int32]Exemplar
+	// cumulative holds the bucket counts of cumulative histograms as of the
+	// end of this interval.
+	cumulative map[string]cumulativeSnapshot
+	// windows holds the sliding windows of histograms as of the end of this
+	// interval.
+	windows map[string]windowSnapshot
 }
 
 // TimerToken facilitates concurrent timings of durations of the same label.
@@ -71,6 +94,8 @@ type TimerToken struct {
 type proportion struct {
 	Value float64
 	Count uint64
+	// Key is the bucket of the value, if it came from a bucketed histogram.
+	Key int32
 }
 
 // proportionArray is a sortable collection of proportion types.
@@ -81,6 +106,12 @@ type MetricSystem struct {
 	// percentiles is a mapping from labels to desired percentiles to be
 	// calculated by the MetricSystem
 	percentiles map[string]float64
+	// percentileErrors selects the companion outputs describing the error
+	// of each percentile.
+	percentileErrors PercentileErrors
+	// interpolatePercentiles estimates percentiles within the value range of
+	// their bucket rather than reporting the bucket's representative value.
+	interpolatePercentiles bool
 	// interval is the duration between collections and broadcasts of metrics
 	// to subscribers.
 	interval time.Duration
@@ -109,25 +140,107 @@ type MetricSystem struct {
 	// subscribersMu controls access to subscription structures
 	subscribersMu sync.RWMutex
 	// counterStore maintains the total counts of counters.
-	counterStore   map[string]*uint64
+	counterStore map[string]*uint64
+	// floatCounterStore maintains the total counts of FloatCounters.
+	floatCounterStore map[string]float64
+	// counterStoreMu controls access to counterStore and floatCounterStore.
 	counterStoreMu sync.RWMutex
-	// counterCache aggregates new Counters until they are collected by reaper().
-	counterCache map[string]*uint64
-	// counterMu controls access to counterCache.
-	counterMu sync.RWMutex
-	// histogramCache aggregates Histograms until they are collected by reaper().
-	histogramCache map[string]map[int16]*uint64
-	// histogramMu controls access to histogramCache.
-	histogramMu sync.RWMutex
+	// shards aggregate new Counters and Histograms until they are collected
+	// by reaper().
+	shards shards
+	// histogramSettings holds a *histogramSettings with the mappings and
+	// backends of histograms that do not use the defaults.
+	histogramSettings atomic.Value
+	// histogramSettingsMu serializes updates of histogramSettings.
+	histogramSettingsMu sync.Mutex
+	// counterHandles and histogramHandles own storage that is drained at
+	// each interval.
+	counterHandles   map[string]*CounterHandle
+	histogramHandles map[string]*HistogramHandle
+	// handlesMu controls access to counterHandles and histogramHandles.
+	handlesMu sync.Mutex
+	// backendCache aggregates histograms with custom backends until they are
+	// collected by reaper().
+	backendCache map[string]HistogramBackend
+	// backendMu controls access to backendCache and the backends within it.
+	backendMu sync.Mutex
 	// histogramCountStore keeps track of aggregate counts and sums for aggregate
-	// mean calculation.
+	// mean calculation.  Sums are stored as the bits of a float64.
 	histogramCountStore map[string]*uint64
 	// histogramCountMu controls access to the histogramCountStore.
 	histogramCountMu sync.RWMutex
+	// cumulative holds the histograms whose bucket counts are kept across
+	// intervals.
+	cumulative map[string]*cumulativeHistogram
+	// cumulativeMu controls access to cumulative.
+	cumulativeMu sync.Mutex
+	// windows holds the sliding windows of histograms.
+	windows map[string]*slidingWindow
+	// windowsMu controls access to windows.
+	windowsMu sync.Mutex
+	// exemplarCache holds the most recent Exemplar of each histogram bucket
+	// until they are collected by reaper().
+	exemplarCache map[string]map[int32]Exemplar
+	// exemplarMu controls access to exemplarCache.
+	exemplarMu sync.Mutex
 	// gaugeFuncs maps metrics to functions used for calculating their value
 	gaugeFuncs map[string]func() float64
 	// gaugeFuncsMu controls access to the gaugeFuncs map.
 	gaugeFuncsMu sync.Mutex
+	// gauges and upDownCounters hold the values pushed by their handles.
+	gauges         map[string]*Gauge
+	upDownCounters map[string]*UpDownCounter
+	// pushGaugesMu controls access to gauges and upDownCounters.
+	pushGaugesMu sync.Mutex
+	// meters holds every Meter, which are ticked at each interval.
+	meters map[string]*Meter
+	// metersMu controls access to meters.
+	metersMu sync.Mutex
+	// registry holds the metadata of registered metrics.
+	registry *registry
+	// derived holds the metrics calculated from the others of each interval.
+	derived *derivedMetrics
+	// alerts holds the alerting rules evaluated at each interval.
+	alerts []*alertRule
+	// notifiers are notified when alerting rules fire and resolve.
+	notifiers []Notifier
+	// lastAlertTime is the time of the latest interval alerts were
+	// evaluated on.
+	lastAlertTime time.Time
+	// alertsMu controls access to alerts, notifiers and lastAlertTime.
+	alertsMu sync.Mutex
+	// slos holds the counts of each tracked SLO.
+	slos map[string]*sloTracker
+	// slosMu controls access to slos.
+	slosMu sync.Mutex
+	// normalizeRates reports counter rates per second rather than per
+	// interval.
+	normalizeRates bool
+	// metricTTL is the number of intervals after which a metric that has
+	// not been updated is forgotten, or 0 to keep metrics forever.
+	metricTTL int
+	// cardinalityLimit is the maximum number of metric names tracked, or 0
+	// for no limit.
+	cardinalityLimit int
+	// lastSeen maps each tracked metric name to the last interval in which
+	// it was updated.
+	lastSeen map[string]uint64
+	// intervalCount is the number of intervals collected so far.
+	intervalCount uint64
+	// namesMu controls access to metricTTL, cardinalityLimit, lastSeen and
+	// intervalCount.
+	namesMu sync.Mutex
+	// clock provides the current time for interval boundaries and timers.
+	clock Clock
+	// rollups are the coarser tiers fed by this MetricSystem's intervals.
+	rollups []*MetricSystem
+	// rollupsMu controls access to rollups.
+	rollupsMu sync.Mutex
+	// rollup is non-nil when this MetricSystem is itself a rollup tier, and
+	// accumulates the intervals of the MetricSystem that feeds it.
+	rollup *rollup
+	// retention keeps recent intervals for querying, when enabled.
+	retention *retention
 	// Has reaper() been started?
 	reaping bool
 	// Close this to bring down this MetricSystem
@@ -163,12 +276,27 @@ func NewMetricSystem(interval time.Duration, sysStats bool) *MetricSystem {
 		processedSubscribers:            make(map[chan *ProcessedMetricSet]struct{}),
 		processedBadSubscribers:         make(map[chan *ProcessedMetricSet]int),
 		counterStore:                    make(map[string]*uint64),
-		counterCache:                    make(map[string]*uint64),
-		histogramCache:                  make(map[string]map[int16]*uint64),
+		floatCounterStore:               make(map[string]float64),
+		shards:                          newShards(defaultShardCount()),
+		counterHandles:                  make(map[string]*CounterHandle),
+		histogramHandles:                make(map[string]*HistogramHandle),
+		backendCache:                    make(map[string]HistogramBackend),
 		histogramCountStore:             make(map[string]*uint64),
+		cumulative:                      make(map[string]*cumulativeHistogram),
+		windows:                         make(map[string]*slidingWindow),
+		exemplarCache:                   make(map[string]map[int32]Exemplar),
 		gaugeFuncs:                      make(map[string]func() float64),
+		gauges:                          make(map[string]*Gauge),
+		upDownCounters:                  make(map[string]*UpDownCounter),
+		meters:                          make(map[string]*Meter),
+		lastSeen:                        make(map[string]uint64),
+		registry:                        newRegistry(),
+		derived:                         &derivedMetrics{},
+		slos:                            make(map[string]*sloTracker),
+		clock:                           realClock{},
 		shutdownChan:                    make(chan struct{}),
 	}
+	ms.histogramSettings.Store(&histogramSettings{})
 	if sysStats {
 		ms.gaugeFuncsMu.Lock()
 		ms.gaugeFuncs["sys.Alloc"] = func() float64 {
@@ -195,11 +323,32 @@ func NewMetricSystem(interval time.Duration, sysStats bool) *MetricSystem {
 }
 
 // SpecifyPercentiles allows users to override the default collected
-// and reported percentiles.
+// and reported percentiles.  Percentiles outside of [0, 1] are logged and
+// never reported.
 func (ms *MetricSystem) SpecifyPercentiles(percentiles map[string]float64) {
+	for label, p := range percentiles {
+		if !(p >= 0 && p <= 1) {
+			glog.Errorf("ignoring percentile %s of %g, which is not between "+
+				"0 and 1", label, p)
+		}
+	}
 	ms.percentiles = percentiles
 }
 
+// InterpolatePercentiles selects whether percentiles of histograms that
+// use a BucketMapping are interpolated within the value range of their
+// bucket, which avoids step artifacts in intervals with few values, rather
+// than reported as the representative value of their bucket.
+func (ms *MetricSystem) InterpolatePercentiles(interpolate bool) {
+	ms.interpolatePercentiles = interpolate
+}
+
+// SetClock overrides the Clock used for interval boundaries, metric
+// timestamps and timer durations.  It must be called before Start.
+func (ms *MetricSystem) SetClock(clock Clock) {
+	ms.clock = clock
+}
+
 // SubscribeToRawMetrics registers a channel to receive RawMetricSets
 // periodically generated by reaper at each interval.
 func (ms *MetricSystem) SubscribeToRawMetrics(metricStream chan *RawMetricSet) {
@@ -232,7 +381,7 @@ func (ms *MetricSystem) UnsubscribeFromProcessedMetrics(
 func (ms *MetricSystem) StartTimer(name string) TimerToken {
 	return TimerToken{
 		Name:         name,
-		Start:        time.Now(),
+		Start:        ms.clock.Now(),
 		MetricSystem: ms,
 	}
 }
@@ -240,7 +389,7 @@ func (ms *MetricSystem) StartTimer(name string) TimerToken {
 // Stop stops a timer given by StartTimer, submits a Histogram of its duration
 // in nanoseconds, and returns its duration in nanoseconds.
 func (tt *TimerToken) Stop() time.Duration {
-	duration := time.Since(tt.Start)
+	duration := tt.MetricSystem.clock.Now().Sub(tt.Start)
 	tt.MetricSystem.Histogram(tt.Name, float64(duration.Nanoseconds()))
 	return duration
 }
@@ -249,49 +398,27 @@ func (tt *TimerToken) Stop() time.Duration {
 // a particular event.  A rate is also exported for the amount that a counter
 // has increased during an interval of this MetricSystem.
 func (ms *MetricSystem) Counter(name string, amount uint64) {
-	ms.counterMu.RLock()
-	_, exists := ms.counterCache[name]
-	// perform lock promotion when we need more control
-	if exists {
-		atomic.AddUint64(ms.counterCache[name], amount)
-		ms.counterMu.RUnlock()
-	} else {
-		ms.counterMu.RUnlock()
-		ms.counterMu.Lock()
-		_, syncExists := ms.counterCache[name]
-		if !syncExists {
-			var z uint64
-			ms.counterCache[name] = &z
-		}
-		atomic.AddUint64(ms.counterCache[name], amount)
-		ms.counterMu.Unlock()
-	}
+	ms.shards.pick().counter(name, amount)
+}
+
+// FloatCounter is like Counter, but accumulates fractional amounts, such as
+// CPU seconds or bytes per request.  Its total and rate are reported as
+// <name> and <name>_rate, so it should not share a name with a Counter.
+func (ms *MetricSystem) FloatCounter(name string, amount float64) {
+	ms.shards.pick().floatCounter(name, amount)
 }
 
 // Histogram is used for generating rich metrics, such as percentiles, from
 // periodically occurring continuous values.
 func (ms *MetricSystem) Histogram(name string, value float64) {
-	compressedValue := compress(value)
-	ms.histogramMu.RLock()
-	_, present := ms.histogramCache[name][compressedValue]
-	if present {
-		atomic.AddUint64(ms.histogramCache[name][compressedValue], 1)
-		ms.histogramMu.RUnlock()
-	} else {
-		ms.histogramMu.RUnlock()
-		ms.histogramMu.Lock()
-		_, syncPresent := ms.histogramCache[name][compressedValue]
-		if !syncPresent {
-			var z uint64
-			_, mapPresent := ms.histogramCache[name]
-			if !mapPresent {
-				ms.histogramCache[name] = make(map[int16]*uint64)
-			}
-			ms.histogramCache[name][compressedValue] = &z
+	settings := ms.loadHistogramSettings()
+	if len(settings.backends) > 0 {
+		if newBackend, present := settings.backends[name]; present {
+			ms.recordBackend(name, value, newBackend)
+			return
 		}
-		atomic.AddUint64(ms.histogramCache[name][compressedValue], 1)
-		ms.histogramMu.Unlock()
 	}
+	ms.shards.pick().histogram(name, settings.mapping(name).Key(value))
 }
 
 // RegisterGaugeFunc registers a function to be called at each interval
@@ -309,43 +436,74 @@ func (ms *MetricSystem) DeregisterGaugeFunc(name string) {
 	ms.gaugeFuncsMu.Unlock()
 }
 
-// compress takes a float64 and lossily shrinks it to an int16 to facilitate
-// bucketing of histogram values, staying within 1% of the true value.  This
-// fails for large values of 1e142 and above, and is inaccurate for values
-// closer to 0 than +/- 0.51 or +/- math.Inf.
-func compress(value float64) int16 {
-	i := int16(precision*math.Log(1.0+math.Abs(value)) + 0.5)
-	if value < 0 {
-		return -1 * i
-	}
-	return i
+// compress takes a float64 and lossily shrinks it to a bucket key using
+// DefaultMapping, staying within 1% of the true value for values further
+// from 0 than +/- 0.51.
+func compress(value float64) int32 {
+	return DefaultMapping.Key(value)
 }
 
-// decompress takes a lossily shrunk int16 and returns a float64 within 1% of
-// the original float64 passed to compress.
-func decompress(compressedValue int16) float64 {
-	f := math.Exp(math.Abs(float64(compressedValue))/precision) - 1.0
-	if compressedValue < 0 {
-		return -1.0 * f
-	}
-	return f
+// decompress takes a bucket key of DefaultMapping and returns a float64
+// within 1% of the original float64 passed to compress.
+func decompress(compressedValue int32) float64 {
+	return DefaultMapping.Value(compressedValue)
 }
 
 // processHistograms derives rich metrics from histograms, currently
-// percentiles, sum, count, and mean.
+// percentiles, sum, count, and mean.  It also returns the bucket of each
+// percentile.
 func (ms *MetricSystem) processHistograms(name string,
-	valuesToCounts map[int16]*uint64) map[string]float64 {
+	valuesToCounts map[int32]*uint64,
+	mapping BucketMapping) (map[string]float64, map[string]int32) {
 	output := make(map[string]float64)
 	totalSum := float64(0)
 	totalCount := uint64(0)
 	proportions := make([]proportion, 0, len(valuesToCounts))
 	for compressedValue, count := range valuesToCounts {
-		value := decompress(compressedValue)
+		value := mapping.Value(compressedValue)
 		totalSum += value * float64(*count)
 		totalCount += *count
-		proportions = append(proportions, proportion{Value: value, Count: *count})
+		proportions = append(proportions, proportion{
+			Value: value,
+			Count: *count,
+			Key:   compressedValue,
+		})
 	}
 
+	ms.summarizeHistogram(name, totalSum, totalCount, output)
+	keys := ms.addPercentiles(name, totalCount, proportions, mapping, output)
+	return output, keys
+}
+
+// addPercentiles adds the percentiles of a bucketed histogram, labeled with
+// name, to output, and returns the bucket of each percentile.
+func (ms *MetricSystem) addPercentiles(name string, totalCount uint64,
+	proportions proportionArray, mapping BucketMapping,
+	output map[string]float64) map[string]int32 {
+	labels, ps := ms.percentileLabels()
+	buckets, err := percentiles(totalCount, proportions, ps)
+	if err != nil {
+		glog.Errorf("unable to calculate percentile: %s", err)
+		return nil
+	}
+	keys := make(map[string]int32, len(buckets))
+	for i, bucket := range buckets {
+		if ms.interpolatePercentiles {
+			bucket.Value = bucket.interpolate(ps[i], totalCount, mapping)
+		}
+		percentileName := fmt.Sprintf(labels[i], name)
+		output[percentileName] = bucket.Value
+		keys[percentileName] = bucket.Key
+		ms.reportPercentileErrors(percentileName, bucket.proportion, mapping,
+			output)
+	}
+	return keys
+}
+
+// summarizeHistogram adds the interval sum, count and mean of a histogram
+// to output, and adds the interval to its aggregate sum and count.
+func (ms *MetricSystem) summarizeHistogram(name string, totalSum float64,
+	totalCount uint64, output map[string]float64) {
 	sumName := fmt.Sprintf("%s_sum", name)
 	countName := fmt.Sprintf("%s_count", name)
 	avgName := fmt.Sprintf("%s_avg", name)
@@ -371,17 +529,21 @@ func (ms *MetricSystem) processHistograms(name string,
 		ms.histogramCountMu.Unlock()
 		ms.histogramCountMu.RLock()
 	}
-	atomic.AddUint64(ms.histogramCountStore[sumName], uint64(totalSum))
+	addFloat64(ms.histogramCountStore[sumName], totalSum)
 	atomic.AddUint64(ms.histogramCountStore[countName], totalCount)
 	ms.histogramCountMu.RUnlock()
+}
 
-	for label, p := range ms.percentiles {
-		value, err := percentile(totalCount, proportions, p)
-		if err != nil {
-			glog.Errorf("unable to calculate percentile: %s", err)
-		} else {
-			output[fmt.Sprintf(label, name)] = value
-		}
+// processBackend derives the same rich metrics as processHistograms from a
+// histogram that uses a custom HistogramBackend.
+func (ms *MetricSystem) processBackend(name string,
+	backend HistogramBackend) map[string]float64 {
+	output := make(map[string]float64)
+	ms.summarizeHistogram(name, backend.Sum(), backend.Count(), output)
+
+	labels, ps := ms.percentileLabels()
+	for i, value := range backend.Quantiles(ps) {
+		output[fmt.Sprintf(labels[i], name)] = value
 	}
 	return output
 }
@@ -400,32 +562,156 @@ func (s proportionArray) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
+// percentileBucket locates a percentile within a proportionArray.
+type percentileBucket struct {
+	proportion
+	// Before is the total count of the proportions preceding this one.
+	Before uint64
+}
+
+// interpolate estimates the value of a percentile by assuming that the
+// values within its bucket are spread evenly between the bucket's bounds.
+func (b percentileBucket) interpolate(percentile float64, totalCount uint64,
+	mapping BucketMapping) float64 {
+	return interpolateBucket(mapping, b.Key, percentile*float64(totalCount),
+		float64(b.Before), float64(b.Count))
+}
+
+// interpolateBucket estimates the value at a target rank within a bucket of
+// a BucketMapping, given the total weight before the bucket and its own
+// weight, assuming its values are spread evenly between its bounds.
+func interpolateBucket(mapping BucketMapping, key int32, target, before,
+	weight float64) float64 {
+	lower, upper := mapping.Bounds(key)
+	fraction := math.Max(0, math.Min(1, (target-before)/weight))
+	return lower + fraction*(upper-lower)
+}
+
 // percentile calculates a percentile represented as a float64 between 0 and 1
 // inclusive from a proportionArray.  totalCount is the sum of all counts of
 // elements in the proportionArray.
 func percentile(totalCount uint64, proportions proportionArray,
 	percentile float64) (float64, error) {
-	//TODO(tyler) handle multiple percentiles at once for efficiency
+	buckets, err := percentiles(totalCount, proportions, []float64{percentile})
+	if err != nil {
+		return 0, err
+	}
+	return buckets[0].Value, nil
+}
+
+// percentiles locates several percentiles, each represented as a float64
+// between 0 and 1 inclusive, with a single sort of and pass over a
+// proportionArray.  The returned buckets are in the same order as
+// requested.
+func percentiles(totalCount uint64, proportions proportionArray,
+	requested []float64) ([]percentileBucket, error) {
 	sort.Sort(proportions)
-	sofar := uint64(0)
-	for _, proportion := range proportions {
-		sofar += proportion.Count
-		if float64(sofar)/float64(totalCount) >= percentile {
-			return proportion.Value, nil
+	weights := make([]float64, len(proportions))
+	for i, proportion := range proportions {
+		weights[i] = float64(proportion.Count)
+	}
+	indices, before, err := locatePercentiles(float64(totalCount), weights,
+		requested)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]percentileBucket, len(requested))
+	for i, index := range indices {
+		buckets[i] = percentileBucket{
+			proportion: proportions[index],
+			Before:     uint64(before[i]),
+		}
+	}
+	return buckets, nil
+}
+
+// locatePercentiles finds the buckets of several percentiles, each between
+// 0 and 1 inclusive, given the weights of the buckets in ascending order
+// of value and their total.  It returns the index of each percentile's
+// bucket and the total weight before that bucket, in the same order as
+// requested.  Weights may be fractional, as for decayed histograms.
+func locatePercentiles(total float64, weights []float64,
+	requested []float64) (indices []int, before []float64, err error) {
+	order := make([]int, len(requested))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return requested[order[i]] < requested[order[j]]
+	})
+
+	indices = make([]int, len(requested))
+	before = make([]float64, len(requested))
+	next := 0
+	sofar := float64(0)
+	for i, weight := range weights {
+		previous := sofar
+		sofar += weight
+		for next < len(order) && sofar/total >= requested[order[next]] {
+			indices[order[next]] = i
+			before[order[next]] = previous
+			next++
+		}
+	}
+	// fractional weights may fall short of their total through rounding
+	for next < len(order) && len(weights) > 0 && requested[order[next]] <= 1 {
+		indices[order[next]] = len(weights) - 1
+		before[order[next]] = sofar - weights[len(weights)-1]
+		next++
+	}
+	if next < len(order) {
+		return nil, nil,
+			errors.New("Invalid percentile.  Should be between 0 and 1.")
+	}
+	return indices, before, nil
+}
+
+// percentileLabels returns the labels and values of the valid percentiles
+// calculated by this MetricSystem as parallel slices.
+func (ms *MetricSystem) percentileLabels() ([]string, []float64) {
+	labels := make([]string, 0, len(ms.percentiles))
+	ps := make([]float64, 0, len(ms.percentiles))
+	for label, p := range ms.percentiles {
+		if !(p >= 0 && p <= 1) {
+			continue
 		}
+		labels = append(labels, label)
+		ps = append(ps, p)
 	}
-	return 0, errors.New("Invalid percentile.  Should be between 0 and 1.")
+	return labels, ps
 }
 
 func (ms *MetricSystem) collectRawMetrics() *RawMetricSet {
-	normalizedInterval := time.Unix(0, time.Now().UnixNano()/
-		ms.interval.Nanoseconds()*
-		ms.interval.Nanoseconds())
+	normalizedInterval := normalizeToInterval(ms.clock.Now(), ms.interval)
+
+	freshCounters, floatRates, histograms := ms.shards.collect()
+	ms.collectHandles(freshCounters, histograms)
+
+	ms.backendMu.Lock()
+	backends := ms.backendCache
+	ms.backendCache = make(map[string]HistogramBackend)
+	ms.backendMu.Unlock()
+
+	ms.gaugeFuncsMu.Lock()
+	gauges := make(map[string]float64)
+	for name, f := range ms.gaugeFuncs {
+		gauges[name] = f()
+	}
+	ms.gaugeFuncsMu.Unlock()
+	ms.collectGauges(gauges)
+	ms.collectMeters(ms.clock.Now(), gauges)
 
-	ms.counterMu.Lock()
-	freshCounters := ms.counterCache
-	ms.counterCache = make(map[string]*uint64)
-	ms.counterMu.Unlock()
+	ms.enforceKinds(freshCounters, floatRates, histograms, backends, gauges)
+	// SLOs count histograms before any are rejected, while their gauges
+	// are added afterwards so that they neither count towards the
+	// cardinality limit nor are rejected by it
+	sloGauges := make(map[string]float64)
+	ms.collectSLOs(histograms, sloGauges)
+	ms.limitCardinality(freshCounters, floatRates, histograms, backends,
+		gauges)
+	for name, value := range sloGauges {
+		gauges[name] = value
+	}
 
 	rates := make(map[string]uint64)
 	for name, count := range freshCounters {
@@ -457,24 +743,37 @@ func (ms *MetricSystem) collectRawMetrics() *RawMetricSet {
 	}
 	ms.counterStoreMu.RUnlock()
 
-	ms.histogramMu.Lock()
-	histograms := ms.histogramCache
-	ms.histogramCache = make(map[string]map[int16]*uint64)
-	ms.histogramMu.Unlock()
+	floatCounters := make(map[string]float64)
+	ms.counterStoreMu.Lock()
+	for name, amount := range floatRates {
+		ms.floatCounterStore[name] += amount
+	}
+	for name, total := range ms.floatCounterStore {
+		floatCounters[name] = total
+	}
+	ms.counterStoreMu.Unlock()
 
-	ms.gaugeFuncsMu.Lock()
-	gauges := make(map[string]float64)
-	for name, f := range ms.gaugeFuncs {
-		gauges[name] = f()
+	settings := ms.loadHistogramSettings()
+	mappings := make(map[string]BucketMapping)
+	for name := range histograms {
+		if mapping, present := settings.mappings[name]; present {
+			mappings[name] = mapping
+		}
 	}
-	ms.gaugeFuncsMu.Unlock()
 
 	return &RawMetricSet{
-		Time:       normalizedInterval,
-		Counters:   counters,
-		Rates:      rates,
-		Histograms: histograms,
-		Gauges:     gauges,
+		Time:          normalizedInterval,
+		Counters:      counters,
+		Rates:         rates,
+		FloatCounters: floatCounters,
+		FloatRates:    floatRates,
+		Histograms:    histograms,
+		Mappings:      mappings,
+		Backends:      backends,
+		Gauges:        gauges,
+		Exemplars:     ms.collectExemplars(histograms),
+		cumulative:    ms.accumulate(histograms),
+		windows:       ms.advanceWindows(histograms),
 	}
 }
 
@@ -483,26 +782,86 @@ func (ms *MetricSystem) collectRawMetrics() *RawMetricSet {
 func (ms *MetricSystem) processMetrics(
 	rawMetrics *RawMetricSet) *ProcessedMetricSet {
 	metrics := make(map[string]float64)
+	// sources maps each output to the name of the metric it came from
+	sources := make(map[string]string)
 
 	for name, count := range rawMetrics.Counters {
 		metrics[name] = float64(count)
+		sources[name] = name
 	}
 
+	rateScale := ms.rateScale()
 	for name, count := range rawMetrics.Rates {
-		metrics[fmt.Sprintf("%s_rate", name)] = float64(count)
+		rateName := fmt.Sprintf("%s_rate", name)
+		metrics[rateName] = float64(count) * rateScale
+		sources[rateName] = name
+	}
+
+	for name, count := range rawMetrics.FloatCounters {
+		metrics[name] = count
+		sources[name] = name
+	}
+
+	for name, count := range rawMetrics.FloatRates {
+		rateName := fmt.Sprintf("%s_rate", name)
+		metrics[rateName] = count * rateScale
+		sources[rateName] = name
 	}
 
+	exemplars := make(map[string]Exemplar)
+	exemplarHistograms := make(map[string]*exemplarHistogram)
 	for name, valuesToCounts := range rawMetrics.Histograms {
-		for histoName, histoValue := range ms.processHistograms(name, valuesToCounts) {
+		histoMetrics, keys := ms.processHistograms(name, valuesToCounts,
+			rawMetrics.Mapping(name))
+		for histoName, histoValue := range histoMetrics {
+			metrics[histoName] = histoValue
+			sources[histoName] = name
+		}
+		if bucketExemplars, present := rawMetrics.Exemplars[name]; present {
+			exemplarHistograms[name] = newExemplarHistogram(valuesToCounts,
+				rawMetrics.Mapping(name), bucketExemplars)
+			for percentileName, key := range keys {
+				if exemplar, present := bucketExemplars[key]; present {
+					exemplars[percentileName] = exemplar
+				}
+			}
+		}
+	}
+
+	for name, backend := range rawMetrics.Backends {
+		for histoName, histoValue := range ms.processBackend(name, backend) {
 			metrics[histoName] = histoValue
+			sources[histoName] = name
 		}
 	}
 
 	for name, value := range rawMetrics.Gauges {
 		metrics[name] = value
+		sources[name] = name
+	}
+
+	for name, snapshot := range rawMetrics.cumulative {
+		for aggName, aggValue := range ms.processCumulative(name, snapshot) {
+			metrics[aggName] = aggValue
+			sources[aggName] = name
+		}
+	}
+
+	for name, snapshot := range rawMetrics.windows {
+		for windowName, windowValue := range ms.processWindow(name, snapshot) {
+			metrics[windowName] = windowValue
+			sources[windowName] = name
+		}
 	}
 
-	return &ProcessedMetricSet{Time: rawMetrics.Time, Metrics: metrics}
+	return &ProcessedMetricSet{
+		Time:      rawMetrics.Time,
+		Metrics:   metrics,
+		Metadata:  ms.describeOutputs(sources),
+		Exemplars: exemplars,
+
+		exemplarHistograms: exemplarHistograms,
+	}
 }
 
 func (ms *MetricSystem) updateSubscribers() {
@@ -524,6 +883,119 @@ func (ms *MetricSystem) updateSubscribers() {
 	}
 }
 
+// publish broadcasts a RawMetricSet to raw subscribers, and hands its
+// processing and broadcast to processed subscribers off to processChan.
+func (ms *MetricSystem) publish(rawMetrics *RawMetricSet,
+	processChan chan func()) {
+	ms.updateSubscribers()
+
+	if ms.retention != nil {
+		ms.retention.retainRaw(rawMetrics)
+	}
+
+	// broadcast raw metrics
+	for subscriber := range ms.rawSubscribers {
+		// new subscribers get all counters, otherwise just the new diffs
+		select {
+		case subscriber <- rawMetrics:
+			delete(ms.rawBadSubscribers, subscriber)
+		default:
+			ms.rawBadSubscribers[subscriber]++
+			glog.Error("a raw subscriber has allowed their channel to fill up. ",
+				"dropping their metrics on the floor rather than blocking.")
+			if ms.rawBadSubscribers[subscriber] >= 2 {
+				glog.Error("this raw subscriber has caused dropped metrics at ",
+					"least 3 times in a row.  closing the channel.")
+				delete(ms.rawSubscribers, subscriber)
+				close(subscriber)
+			}
+		}
+	}
+
+	// Perform the rest in another goroutine since processing is not
+	// guaranteed to complete before the interval is up.
+	sendProcessed := func() {
+		// this is potentially expensive if there is a massive number of metrics
+		processedMetrics := ms.processMetrics(rawMetrics)
+
+		// add aggregate mean
+		histogramNames := make([]string, 0,
+			len(rawMetrics.Histograms)+len(rawMetrics.Backends))
+		for name := range rawMetrics.Histograms {
+			histogramNames = append(histogramNames, name)
+		}
+		for name := range rawMetrics.Backends {
+			histogramNames = append(histogramNames, name)
+		}
+		aggSources := make(map[string]string)
+		for _, name := range histogramNames {
+			ms.histogramCountMu.RLock()
+			aggCountPtr, countPresent :=
+				ms.histogramCountStore[fmt.Sprintf("%s_count", name)]
+			aggSumPtr, sumPresent :=
+				ms.histogramCountStore[fmt.Sprintf("%s_sum", name)]
+			var aggCount uint64
+			var aggSum float64
+			if countPresent && sumPresent {
+				aggCount = atomic.LoadUint64(aggCountPtr)
+				aggSum = math.Float64frombits(atomic.LoadUint64(aggSumPtr))
+			}
+			ms.histogramCountMu.RUnlock()
+
+			if aggCount > 0 {
+				processedMetrics.Metrics[fmt.Sprintf("%s_agg_avg", name)] =
+					aggSum / float64(aggCount)
+				processedMetrics.Metrics[fmt.Sprintf("%s_agg_count", name)] =
+					float64(aggCount)
+				processedMetrics.Metrics[fmt.Sprintf("%s_agg_sum", name)] =
+					aggSum
+				for _, suffix := range []string{"avg", "count", "sum"} {
+					aggSources[fmt.Sprintf("%s_agg_%s", name, suffix)] = name
+				}
+			}
+		}
+		// derived metrics may refer to any output, including aggregates
+		ms.addDerived(rawMetrics, processedMetrics.Metrics, aggSources)
+		for output, metadata := range ms.describeOutputs(aggSources) {
+			processedMetrics.Metadata[output] = metadata
+		}
+
+		ms.evaluateAlerts(rawMetrics, processedMetrics)
+
+		if ms.retention != nil {
+			ms.retention.retainProcessed(rawMetrics, processedMetrics)
+		}
+
+		// broadcast processed metrics
+		ms.subscribersMu.Lock()
+		for subscriber := range ms.processedSubscribers {
+			select {
+			case subscriber <- processedMetrics:
+				delete(ms.processedBadSubscribers, subscriber)
+			default:
+				ms.processedBadSubscribers[subscriber]++
+				glog.Error("a subscriber has allowed their channel to fill up. ",
+					"dropping their metrics on the floor rather than blocking.")
+				if ms.processedBadSubscribers[subscriber] >= 2 {
+					glog.Error("this subscriber has caused dropped metrics at ",
+						"least 3 times in a row.  closing the channel.")
+					delete(ms.processedSubscribers, subscriber)
+					close(subscriber)
+				}
+			}
+		}
+		ms.subscribersMu.Unlock()
+	}
+	select {
+	case processChan <- sendProcessed:
+	default:
+		// processChan has filled up, this metric load is not sustainable
+		glog.Errorf("processing of metrics is taking longer than this node can "+
+			"handle.  dropping this entire interval of %s metrics on the "+
+			"floor rather than blocking the reaper.", rawMetrics.Time)
+	}
+}
+
 // reaper wakes up every <interval> seconds,
 // collects and processes metrics, and pushes
 // them to the corresponding subscribing channels.
@@ -547,10 +1019,9 @@ func (ms *MetricSystem) reaper() {
 	// begin reaper main loop
 	for {
 		// sleep until the next interval, or die if shutdownChan is closed
-		tts := ms.interval.Nanoseconds() -
-			(time.Now().UnixNano() % ms.interval.Nanoseconds())
+		tts := timeUntilNextInterval(ms.clock.Now(), ms.interval)
 		select {
-		case <-time.After(time.Duration(tts)):
+		case <-ms.clock.After(tts):
 		case <-ms.shutdownChan:
 			ms.reaping = false
 			close(processChan)
@@ -558,83 +1029,15 @@ func (ms *MetricSystem) reaper() {
 		}
 
 		rawMetrics := ms.collectRawMetrics()
+		ms.publish(rawMetrics, processChan)
 
-		ms.updateSubscribers()
-
-		// broadcast raw metrics
-		for subscriber := range ms.rawSubscribers {
-			// new subscribers get all counters, otherwise just the new diffs
-			select {
-			case subscriber <- rawMetrics:
-				delete(ms.rawBadSubscribers, subscriber)
-			default:
-				ms.rawBadSubscribers[subscriber]++
-				glog.Error("a raw subscriber has allowed their channel to fill up. ",
-					"dropping their metrics on the floor rather than blocking.")
-				if ms.rawBadSubscribers[subscriber] >= 2 {
-					glog.Error("this raw subscriber has caused dropped metrics at ",
-						"least 3 times in a row.  closing the channel.")
-					delete(ms.rawSubscribers, subscriber)
-					close(subscriber)
-				}
+		// feed the coarser rollup tiers, which publish whenever one of their
+		// own intervals has been completed.
+		for _, rollup := range ms.rollupSystems() {
+			for _, rolledUp := range rollup.rollup.merge(rawMetrics) {
+				rollup.publish(rolledUp, processChan)
 			}
 		}
-
-		// Perform the rest in another goroutine since processing is not
-		// guaranteed to complete before the interval is up.
-		sendProcessed := func() {
-			// this is potentially expensive if there is a massive number of metrics
-			processedMetrics := ms.processMetrics(rawMetrics)
-
-			// add aggregate mean
-			for name := range rawMetrics.Histograms {
-				ms.histogramCountMu.RLock()
-				aggCountPtr, countPresent :=
-					ms.histogramCountStore[fmt.Sprintf("%s_count", name)]
-				aggCount := atomic.LoadUint64(aggCountPtr)
-				aggSumPtr, sumPresent :=
-					ms.histogramCountStore[fmt.Sprintf("%s_sum", name)]
-				aggSum := atomic.LoadUint64(aggSumPtr)
-				ms.histogramCountMu.RUnlock()
-
-				if countPresent && sumPresent && aggCount > 0 {
-					processedMetrics.Metrics[fmt.Sprintf("%s_agg_avg", name)] =
-						float64(aggSum / aggCount)
-					processedMetrics.Metrics[fmt.Sprintf("%s_agg_count", name)] =
-						float64(aggCount)
-					processedMetrics.Metrics[fmt.Sprintf("%s_agg_sum", name)] =
-						float64(aggSum)
-				}
-			}
-
-			// broadcast processed metrics
-			ms.subscribersMu.Lock()
-			for subscriber := range ms.processedSubscribers {
-				select {
-				case subscriber <- processedMetrics:
-					delete(ms.processedBadSubscribers, subscriber)
-				default:
-					ms.processedBadSubscribers[subscriber]++
-					glog.Error("a subscriber has allowed their channel to fill up. ",
-						"dropping their metrics on the floor rather than blocking.")
-					if ms.processedBadSubscribers[subscriber] >= 2 {
-						glog.Error("this subscriber has caused dropped metrics at ",
-							"least 3 times in a row.  closing the channel.")
-						delete(ms.processedSubscribers, subscriber)
-						close(subscriber)
-					}
-				}
-			}
-			ms.subscribersMu.Unlock()
-		}
-		select {
-		case processChan <- sendProcessed:
-		default:
-			// processChan has filled up, this metric load is not sustainable
-			glog.Errorf("processing of metrics is taking longer than this node can "+
-				"handle.  dropping this entire interval of %s metrics on the "+
-				"floor rather than blocking the reaper.", rawMetrics.Time)
-		}
 	} // end main reaper loop
 }
 
@@ -642,7 +1045,8 @@ func (ms *MetricSystem) reaper() {
 // metric submitters, and a reaper goroutine that harvests metrics at the
 // default interval of every 60 seconds.
 func (ms *MetricSystem) Start() {
-	if !ms.reaping {
+	// rollup tiers are driven by the reaper of the MetricSystem feeding them
+	if !ms.reaping && ms.rollup == nil {
 		go ms.reaper()
 	}
 }
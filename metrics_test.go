@@ -21,8 +21,11 @@ import (
 	"fmt"
 	"math"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/spacejam/loghisto/clocktest"
 )
 
 func ExampleMetricSystem() {
@@ -239,6 +242,33 @@ func TestCounter(t *testing.T) {
 
 }
 
+func TestFloatCounter(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				metricSystem.FloatCounter("cpu.seconds", .25)
+			}
+		}()
+	}
+	wg.Wait()
+	metrics := metricSystem.processMetrics(metricSystem.collectRawMetrics()).Metrics
+	if metrics["cpu.seconds"] != 400 || metrics["cpu.seconds_rate"] != 400 {
+		t.Errorf("expected a total and rate of 400, got %f and %f",
+			metrics["cpu.seconds"], metrics["cpu.seconds_rate"])
+	}
+
+	metricSystem.FloatCounter("cpu.seconds", 1.5)
+	metrics = metricSystem.processMetrics(metricSystem.collectRawMetrics()).Metrics
+	if metrics["cpu.seconds"] != 401.5 || metrics["cpu.seconds_rate"] != 1.5 {
+		t.Errorf("expected a total of 401.5 and rate of 1.5, got %f and %f",
+			metrics["cpu.seconds"], metrics["cpu.seconds_rate"])
+	}
+}
+
 func TestUpdateSubscribers(t *testing.T) {
 	rawMetricStream := make(chan *RawMetricSet)
 	processedMetricStream := make(chan *ProcessedMetricSet)
@@ -361,3 +391,145 @@ func TestMetricSystemStop(t *testing.T) {
 			"before: %d, after: %d\n", startingRoutines, endRoutines)
 	}
 }
+
+func TestClockDrivesIntervals(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(100, 500))
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetClock(clock)
+	rawMetricStream := make(chan *RawMetricSet, 16)
+	metricSystem.SubscribeToRawMetrics(rawMetricStream)
+	metricSystem.Start()
+	defer metricSystem.Stop()
+
+	token := metricSystem.StartTimer("timer2")
+	clock.Advance(5 * time.Millisecond)
+	if d := token.Stop(); d != 5*time.Millisecond {
+		t.Errorf("expected timer duration of 5ms, got %s", d)
+	}
+
+	clock.BlockUntil(1)
+	clock.Set(time.Unix(101, 0))
+
+	select {
+	case rawMetrics := <-rawMetricStream:
+		if !rawMetrics.Time.Equal(time.Unix(101, 0)) {
+			t.Errorf("expected interval time %s, got %s",
+				time.Unix(101, 0), rawMetrics.Time)
+		}
+		if _, present := rawMetrics.Histograms["timer2"]; !present {
+			t.Error("expected timer2 histogram in raw metrics")
+		}
+	case <-time.After(time.Second):
+		t.Error("received no metrics after advancing the clock")
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	metrics := map[float64]uint64{
+		10:  9000,
+		25:  900,
+		33:  90,
+		47:  9,
+		500: 1,
+	}
+	totalcount := uint64(0)
+	proportions := make([]proportion, 0, len(metrics))
+	for value, count := range metrics {
+		totalcount += count
+		proportions = append(proportions, proportion{Value: value, Count: count})
+	}
+
+	requested := []float64{1, .9991, 0, .999, .99}
+	buckets, err := percentiles(totalcount, proportions, requested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range requested {
+		expected, _ := percentile(totalcount, proportions, p)
+		if buckets[i].Value != expected {
+			t.Errorf("percentile %f: expected %f, got %f", p, expected,
+				buckets[i].Value)
+		}
+	}
+	if buckets[0].Before != totalcount-1 {
+		t.Errorf("expected 1 value in the max bucket, got %d",
+			totalcount-buckets[0].Before)
+	}
+
+	if _, err := percentiles(totalcount, proportions, []float64{1.5}); err == nil {
+		t.Error("expected an error for a percentile above 1")
+	}
+}
+
+func TestInvalidPercentileLabel(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyPercentiles(map[string]float64{
+		"%s_50":  .5,
+		"%s_bad": 1.5,
+	})
+	metricSystem.Histogram("x", 10)
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	if _, present := metrics["x_50"]; !present {
+		t.Error("expected valid percentiles despite an invalid one")
+	}
+	if _, present := metrics["x_bad"]; present {
+		t.Error("expected the invalid percentile to be skipped")
+	}
+}
+
+func TestInterpolatePercentiles(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyPercentiles(map[string]float64{
+		"%s_25": .25,
+		"%s_50": .5,
+		"%s_75": .75,
+	})
+	metricSystem.InterpolatePercentiles(true)
+	for i := 0; i < 4; i++ {
+		metricSystem.Histogram("few", 1000)
+	}
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+
+	lower, upper := DefaultMapping.Bounds(compress(1000))
+	previous := lower
+	for _, name := range []string{"few_25", "few_50", "few_75"} {
+		value := metrics[name]
+		if value <= previous || value > upper {
+			t.Errorf("expected %s to increase within [%f, %f], got %f after %f",
+				name, lower, upper, value, previous)
+		}
+		previous = value
+	}
+}
+
+func TestAggregateSums(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyHistogramRelativeAccuracy("offset", .001)
+	processedMetricStream := make(chan *ProcessedMetricSet, 2)
+	metricSystem.SubscribeToProcessedMetrics(processedMetricStream)
+	processChan := make(chan func(), 2)
+
+	var processed *ProcessedMetricSet
+	for _, value := range []float64{-.25, -.5} {
+		metricSystem.Histogram("offset", value)
+		metricSystem.publish(metricSystem.collectRawMetrics(), processChan)
+		(<-processChan)()
+		processed = <-processedMetricStream
+	}
+
+	metrics := processed.Metrics
+	if math.Abs(metrics["offset_agg_sum"]+.75) > .75*.001 {
+		t.Errorf("expected an aggregate sum of -0.75, got %f",
+			metrics["offset_agg_sum"])
+	}
+	if math.Abs(metrics["offset_agg_avg"]+.375) > .375*.001 {
+		t.Errorf("expected an aggregate mean of -0.375, got %f",
+			metrics["offset_agg_avg"])
+	}
+	if metrics["offset_agg_count"] != 2 {
+		t.Errorf("expected an aggregate count of 2, got %f",
+			metrics["offset_agg_count"])
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; " +
+		"charset=utf-8"
+)
+
+// prometheusName converts a metric name into a valid Prometheus metric
+// name by replacing every disallowed character with an underscore.
+func prometheusName(name string) string {
+	var b bytes.Buffer
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// prometheusValue formats a sample value.
+func prometheusValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escapeHelp escapes help text for a HELP line.
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// outputType returns the type of a processed output of a registered
+// metric.  Only the running total of a counter is monotonic; its rate, and
+// every output of a histogram, describe a single interval.
+func outputType(output string, metadata MetricMetadata) string {
+	if metadata.Kind == CounterKind && output == metadata.Name {
+		return "counter"
+	}
+	return "gauge"
+}
+
+// sortedOutputs returns the names of the metrics of a ProcessedMetricSet in
+// order.
+func (metricSet *ProcessedMetricSet) sortedOutputs() []string {
+	outputs := make([]string, 0, len(metricSet.Metrics))
+	for output := range metricSet.Metrics {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	return outputs
+}
+
+// PrometheusProtocol generates the Prometheus text exposition format of a
+// ProcessedMetricSet.  Outputs of registered metrics are preceded by HELP
+// and TYPE lines; others are left untyped.
+func PrometheusProtocol(metricSet *ProcessedMetricSet) []byte {
+	var request bytes.Buffer
+	for _, output := range metricSet.sortedOutputs() {
+		name := prometheusName(output)
+		if metadata, present := metricSet.Metadata[output]; present {
+			if metadata.Help != "" {
+				fmt.Fprintf(&request, "# HELP %s %s\n", name,
+					escapeHelp(metadata.Help))
+			}
+			fmt.Fprintf(&request, "# TYPE %s %s\n", name,
+				outputType(output, metadata))
+		}
+		fmt.Fprintf(&request, "%s %s\n", name,
+			prometheusValue(metricSet.Metrics[output]))
+	}
+	return request.Bytes()
+}
+
+// exemplarSuffix formats an exemplar for appending to an OpenMetrics
+// sample.
+func exemplarSuffix(exemplar Exemplar) string {
+	traceID := strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).
+		Replace(exemplar.TraceID)
+	// exemplar timestamps are in seconds
+	timestamp := float64(exemplar.Time.UnixNano()/int64(time.Millisecond)) / 1e3
+	return fmt.Sprintf(` # {trace_id="%s"} %s %s`, traceID,
+		prometheusValue(exemplar.Value),
+		strconv.FormatFloat(timestamp, 'f', 3, 64))
+}
+
+// writeExemplarHistogram writes a histogram recorded with exemplars as an
+// OpenMetrics gauge histogram of its interval, whose bucket samples carry
+// the exemplars, as OpenMetrics only permits exemplars on buckets and
+// counters.
+func writeExemplarHistogram(request *bytes.Buffer, name string,
+	h *exemplarHistogram) {
+	name = prometheusName(name)
+	fmt.Fprintf(request, "# TYPE %s gaugehistogram\n", name)
+	var inf *exemplarBucket
+	for i := range h.buckets {
+		bucket := &h.buckets[i]
+		if math.IsInf(bucket.upper, 1) {
+			inf = bucket
+			break
+		}
+		fmt.Fprintf(request, "%s_bucket{le=\"%s\"} %d", name,
+			prometheusValue(bucket.upper), bucket.cumulative)
+		if bucket.hasExemplar {
+			request.WriteString(exemplarSuffix(bucket.exemplar))
+		}
+		request.WriteString("\n")
+	}
+	fmt.Fprintf(request, "%s_bucket{le=\"+Inf\"} %d", name, h.count)
+	if inf != nil && inf.hasExemplar {
+		request.WriteString(exemplarSuffix(inf.exemplar))
+	}
+	request.WriteString("\n")
+	fmt.Fprintf(request, "%s_gcount %d\n", name, h.count)
+	fmt.Fprintf(request, "%s_gsum %s\n", name, prometheusValue(h.sum))
+}
+
+// OpenMetricsProtocol generates the OpenMetrics text format of a
+// ProcessedMetricSet.  Outputs of registered metrics are preceded by TYPE,
+// UNIT and HELP lines, and their names are suffixed with their unit as
+// OpenMetrics requires.  Histograms recorded with HistogramWithExemplar
+// are also written as gauge histograms of their interval, named after the
+// histogram, whose buckets carry their exemplars.
+func OpenMetricsProtocol(metricSet *ProcessedMetricSet) []byte {
+	var request bytes.Buffer
+	for _, output := range metricSet.sortedOutputs() {
+		name := prometheusName(output)
+		value := prometheusValue(metricSet.Metrics[output])
+		metadata, present := metricSet.Metadata[output]
+		if !present {
+			fmt.Fprintf(&request, "%s %s\n", name, value)
+			continue
+		}
+
+		metricType := outputType(output, metadata)
+		if metricType == "counter" {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		unit := prometheusName(metadata.Unit)
+		if unit != "" && !strings.HasSuffix(name, "_"+unit) {
+			name = fmt.Sprintf("%s_%s", name, unit)
+		}
+		fmt.Fprintf(&request, "# TYPE %s %s\n", name, metricType)
+		if unit != "" {
+			fmt.Fprintf(&request, "# UNIT %s %s\n", name, unit)
+		}
+		if metadata.Help != "" {
+			fmt.Fprintf(&request, "# HELP %s %s\n", name,
+				strings.Replace(escapeHelp(metadata.Help), `"`, `\"`, -1))
+		}
+		if metricType == "counter" {
+			name += "_total"
+		}
+		fmt.Fprintf(&request, "%s %s\n", name, value)
+	}
+
+	names := make([]string, 0, len(metricSet.exemplarHistograms))
+	for name := range metricSet.exemplarHistograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeExemplarHistogram(&request, name,
+			metricSet.exemplarHistograms[name])
+	}
+	request.WriteString("# EOF\n")
+	return request.Bytes()
+}
+
+// prometheusExporter serves the newest processed interval of a
+// MetricSystem.
+type prometheusExporter struct {
+	ms *MetricSystem
+}
+
+// PrometheusHandler returns an http.Handler that serves the newest
+// processed interval of a MetricSystem for scraping by Prometheus, in the
+// OpenMetrics format if the scraper accepts it and in the Prometheus text
+// format otherwise.  RetainIntervals must be called, though retaining a
+// single interval is enough.
+func PrometheusHandler(ms *MetricSystem) http.Handler {
+	return &prometheusExporter{ms: ms}
+}
+
+func (p *prometheusExporter) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	if p.ms.retention == nil {
+		http.Error(w, "no intervals are retained, call RetainIntervals",
+			http.StatusServiceUnavailable)
+		return
+	}
+	newest := p.ms.retention.newest()
+	if newest == nil {
+		http.Error(w, "no interval has been processed yet",
+			http.StatusServiceUnavailable)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+		w.Header().Set("Content-Type", openMetricsContentType)
+		w.Write(OpenMetricsProtocol(newest))
+		return
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.Write(PrometheusProtocol(newest))
+}
@@ -0,0 +1,131 @@
+package loghisto
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusProtocol(t *testing.T) {
+	metrics := &ProcessedMetricSet{
+		Time: time.Unix(0, 0),
+		Metrics: map[string]float64{
+			"rpc.requests":      5,
+			"rpc.requests_rate": 1.5,
+			"latency_99.9":      math.NaN(),
+			"9lives":            9,
+		},
+		Metadata: map[string]MetricMetadata{
+			"rpc.requests": {Name: "rpc.requests", Kind: CounterKind,
+				Help: "Requests\nserved."},
+			"rpc.requests_rate": {Name: "rpc.requests", Kind: CounterKind,
+				Help: "Requests\nserved."},
+			"latency_99.9": {Name: "latency", Kind: HistogramKind,
+				Unit: "seconds"},
+		},
+	}
+	expected := "_9lives 9\n" +
+		"# TYPE latency_99_9 gauge\n" +
+		"latency_99_9 NaN\n" +
+		"# HELP rpc_requests Requests\\nserved.\n" +
+		"# TYPE rpc_requests counter\n" +
+		"rpc_requests 5\n" +
+		"# HELP rpc_requests_rate Requests\\nserved.\n" +
+		"# TYPE rpc_requests_rate gauge\n" +
+		"rpc_requests_rate 1.5\n"
+	if actual := string(PrometheusProtocol(metrics)); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestOpenMetricsProtocol(t *testing.T) {
+	metrics := &ProcessedMetricSet{
+		Time: time.Unix(0, 0),
+		Metrics: map[string]float64{
+			"sent_total": 5,
+			"latency_99": .25,
+			"other":      1,
+		},
+		Metadata: map[string]MetricMetadata{
+			"sent_total": {Name: "sent_total", Kind: CounterKind, Unit: "bytes",
+				Help: `Bytes "sent".`},
+			"latency_99": {Name: "latency", Kind: HistogramKind,
+				Unit: "seconds"},
+		},
+	}
+	expected := "# TYPE latency_99_seconds gauge\n" +
+		"# UNIT latency_99_seconds seconds\n" +
+		"latency_99_seconds 0.25\n" +
+		"other 1\n" +
+		"# TYPE sent_bytes counter\n" +
+		"# UNIT sent_bytes bytes\n" +
+		"# HELP sent_bytes Bytes \\\"sent\\\".\n" +
+		"sent_bytes_total 5\n" +
+		"# EOF\n"
+	if actual := string(OpenMetricsProtocol(metrics)); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	recorder := httptest.NewRecorder()
+	PrometheusHandler(metricSystem).ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != 503 {
+		t.Errorf("expected 503 without retention, got %d", recorder.Code)
+	}
+
+	metricSystem.RetainIntervals(2)
+	metricSystem.Register("requests", CounterKind, "", "Requests served.")
+	metricSystem.Counter("requests", 3)
+	rawMetrics := metricSystem.collectRawMetrics()
+	metricSystem.retention.retainRaw(rawMetrics)
+	metricSystem.retention.retainProcessed(rawMetrics,
+		metricSystem.processMetrics(rawMetrics))
+
+	recorder = httptest.NewRecorder()
+	PrometheusHandler(metricSystem).ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(),
+		"# TYPE requests counter\nrequests 3\n") {
+		t.Errorf("unexpected exposition %q", recorder.Body.String())
+	}
+
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	request.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	recorder = httptest.NewRecorder()
+	PrometheusHandler(metricSystem).ServeHTTP(recorder, request)
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+		"application/openmetrics-text") {
+		t.Errorf("expected an OpenMetrics content type, got %q", ct)
+	}
+	if !strings.Contains(recorder.Body.String(), "requests_total 3\n") {
+		t.Errorf("unexpected exposition %q", recorder.Body.String())
+	}
+}
+
+func TestPrometheusHandlerSingleInterval(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.RetainIntervals(1)
+	metricSystem.Counter("requests", 3)
+	first := metricSystem.collectRawMetrics()
+	metricSystem.retention.retainRaw(first)
+	metricSystem.Counter("requests", 4)
+	second := metricSystem.collectRawMetrics()
+	// the second interval is retained before the first finishes processing
+	metricSystem.retention.retainRaw(second)
+	metricSystem.retention.retainProcessed(first,
+		metricSystem.processMetrics(first))
+
+	recorder := httptest.NewRecorder()
+	PrometheusHandler(metricSystem).ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != 200 ||
+		!strings.Contains(recorder.Body.String(), "requests 3\n") {
+		t.Errorf("expected the first interval, got %d %q", recorder.Code,
+			recorder.Body.String())
+	}
+}
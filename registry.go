@@ -0,0 +1,182 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// MetricKind is the kind of a registered metric, which determines the
+// recording functions that may be used with its name.
+type MetricKind int
+
+const (
+	// CounterKind is recorded with Counter, FloatCounter or a CounterHandle.
+	CounterKind MetricKind = iota + 1
+	// GaugeKind is reported by RegisterGaugeFunc, a Gauge or an
+	// UpDownCounter.
+	GaugeKind
+	// HistogramKind is recorded with Histogram, a HistogramHandle or a
+	// timer.
+	HistogramKind
+)
+
+func (k MetricKind) String() string {
+	switch k {
+	case CounterKind:
+		return "counter"
+	case GaugeKind:
+		return "gauge"
+	case HistogramKind:
+		return "histogram"
+	}
+	return fmt.Sprintf("MetricKind(%d)", int(k))
+}
+
+// MetricMetadata describes a registered metric.
+type MetricMetadata struct {
+	// Name is the name the metric was registered under.  The processed
+	// outputs of the metric, such as <name>_rate or <name>_99, share it.
+	Name string
+	Kind MetricKind
+	// Unit is the unit of the metric's values, such as "seconds" or
+	// "bytes", or "" if it has none.
+	Unit string
+	Help string
+}
+
+// registry holds the metadata of registered metrics.  It is shared by a
+// MetricSystem and its rollup tiers.
+type registry struct {
+	mu      sync.RWMutex
+	metrics map[string]*MetricMetadata
+}
+
+func newRegistry() *registry {
+	return &registry{metrics: make(map[string]*MetricMetadata)}
+}
+
+// Register records the kind, unit and help text of a metric, which
+// exporters such as PrometheusProtocol emit alongside its values.  Once a
+// name is registered, values recorded under it as a different kind are
+// dropped at the end of each interval and logged.  Registering a name again
+// updates its unit and help text, but its kind may not change.
+func (ms *MetricSystem) Register(name string, kind MetricKind, unit,
+	help string) error {
+	if kind < CounterKind || kind > HistogramKind {
+		return fmt.Errorf("unable to register %s with unknown kind %s", name,
+			kind)
+	}
+	ms.registry.mu.Lock()
+	defer ms.registry.mu.Unlock()
+	if existing, present := ms.registry.metrics[name]; present &&
+		existing.Kind != kind {
+		return fmt.Errorf("unable to register %s as a %s, it is already "+
+			"registered as a %s", name, kind, existing.Kind)
+	}
+	ms.registry.metrics[name] = &MetricMetadata{
+		Name: name,
+		Kind: kind,
+		Unit: unit,
+		Help: help,
+	}
+	return nil
+}
+
+// Metadata returns the metadata of a registered metric.
+func (ms *MetricSystem) Metadata(name string) (MetricMetadata, bool) {
+	ms.registry.mu.RLock()
+	defer ms.registry.mu.RUnlock()
+	metadata, present := ms.registry.metrics[name]
+	if !present {
+		return MetricMetadata{}, false
+	}
+	return *metadata, true
+}
+
+// misused returns true and logs an error if name is registered as a kind
+// other than kind.  mu must be held.
+func (r *registry) misused(name string, kind MetricKind) bool {
+	metadata, present := r.metrics[name]
+	if !present || metadata.Kind == kind {
+		return false
+	}
+	glog.Errorf("dropping %s recorded as a %s, it is registered as a %s",
+		name, kind, metadata.Kind)
+	return true
+}
+
+// enforceKinds drops the metrics collected in an interval whose names are
+// registered as a different kind.
+func (ms *MetricSystem) enforceKinds(counters map[string]*uint64,
+	floatCounters map[string]float64,
+	histograms map[string]map[int32]*uint64,
+	backends map[string]HistogramBackend, gauges map[string]float64) {
+	r := ms.registry
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.metrics) == 0 {
+		return
+	}
+	for name := range counters {
+		if r.misused(name, CounterKind) {
+			delete(counters, name)
+		}
+	}
+	for name := range floatCounters {
+		if r.misused(name, CounterKind) {
+			delete(floatCounters, name)
+		}
+	}
+	for name := range histograms {
+		if r.misused(name, HistogramKind) {
+			delete(histograms, name)
+		}
+	}
+	for name := range backends {
+		if r.misused(name, HistogramKind) {
+			delete(backends, name)
+		}
+	}
+	for name := range gauges {
+		if r.misused(name, GaugeKind) {
+			delete(gauges, name)
+		}
+	}
+}
+
+// describeOutputs returns the metadata of each processed output whose
+// source metric, given by sources, is registered.
+func (ms *MetricSystem) describeOutputs(
+	sources map[string]string) map[string]MetricMetadata {
+	described := make(map[string]MetricMetadata)
+	ms.registry.mu.RLock()
+	defer ms.registry.mu.RUnlock()
+	if len(ms.registry.metrics) == 0 {
+		return described
+	}
+	for output, source := range sources {
+		if metadata, present := ms.registry.metrics[source]; present {
+			described[output] = *metadata
+		}
+	}
+	return described
+}
@@ -0,0 +1,100 @@
+package loghisto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	if err := metricSystem.Register("requests", CounterKind, "requests",
+		"Requests served."); err != nil {
+		t.Fatal(err)
+	}
+	if err := metricSystem.Register("requests", CounterKind, "",
+		"Requests handled."); err != nil {
+		t.Errorf("expected re-registration of the same kind to succeed: %s",
+			err)
+	}
+	if err := metricSystem.Register("requests", HistogramKind, "",
+		""); err == nil {
+		t.Error("expected changing the kind of a metric to fail")
+	}
+	if err := metricSystem.Register("bogus", MetricKind(42), "",
+		""); err == nil {
+		t.Error("expected registering an unknown kind to fail")
+	}
+
+	metadata, present := metricSystem.Metadata("requests")
+	if !present || metadata.Kind != CounterKind ||
+		metadata.Help != "Requests handled." {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+	if _, present := metricSystem.Metadata("bogus"); present {
+		t.Error("expected no metadata for an unregistered metric")
+	}
+}
+
+func TestRegisteredKindsEnforced(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.Register("requests", CounterKind, "", "")
+	metricSystem.Register("latency", HistogramKind, "seconds", "")
+	metricSystem.Register("depth", GaugeKind, "", "")
+
+	metricSystem.Histogram("requests", 1)
+	metricSystem.Counter("latency", 1)
+	metricSystem.NewGauge("requests").Set(1)
+	metricSystem.Counter("depth", 1)
+	metricSystem.Counter("requests", 2)
+	metricSystem.Histogram("latency", 3)
+	metricSystem.NewGauge("depth").Set(4)
+
+	rawMetrics := metricSystem.collectRawMetrics()
+	if _, present := rawMetrics.Rates["latency"]; present {
+		t.Error("expected a counter recorded under a histogram's name to be " +
+			"dropped")
+	}
+	if _, present := rawMetrics.Rates["depth"]; present {
+		t.Error("expected a counter recorded under a gauge's name to be " +
+			"dropped")
+	}
+	if len(rawMetrics.Histograms["requests"]) != 0 {
+		t.Error("expected a histogram recorded under a counter's name to be " +
+			"dropped")
+	}
+	if rawMetrics.Gauges["requests"] != 0 {
+		t.Error("expected a gauge recorded under a counter's name to be " +
+			"dropped")
+	}
+	if rawMetrics.Rates["requests"] != 2 || len(rawMetrics.Histograms["latency"]) != 1 ||
+		rawMetrics.Gauges["depth"] != 4 {
+		t.Error("expected metrics of their registered kinds to be kept")
+	}
+}
+
+func TestProcessedMetadata(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.Register("latency", HistogramKind, "seconds", "Latency.")
+	metricSystem.Histogram("latency", 3)
+	metricSystem.Histogram("unregistered", 3)
+
+	processed := metricSystem.processMetrics(metricSystem.collectRawMetrics())
+	for _, output := range []string{"latency_99", "latency_count", "latency_max"} {
+		if metadata := processed.Metadata[output]; metadata.Name != "latency" ||
+			metadata.Unit != "seconds" {
+			t.Errorf("expected metadata of latency for %s, got %+v", output,
+				metadata)
+		}
+	}
+	if _, present := processed.Metadata["unregistered_99"]; present {
+		t.Error("expected no metadata for an unregistered metric")
+	}
+
+	tier, err := metricSystem.NewRollup(2*time.Second, GaugeLast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, present := tier.Metadata("latency"); !present {
+		t.Error("expected rollup tiers to share the registry")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Point is a single value of a metric series.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// retainedInterval holds the raw and processed forms of one interval.  The
+// processed form is filled in once processing of the interval completes.
+type retainedInterval struct {
+	raw       *RawMetricSet
+	processed *ProcessedMetricSet
+}
+
+// retention is a ring of the most recent intervals of a MetricSystem.
+type retention struct {
+	mu        sync.RWMutex
+	intervals []*retainedInterval
+	// next is the position in intervals that will be overwritten next.
+	next int
+	// latest is the newest interval whose processing has completed.  It is
+	// kept apart from intervals because, with few retained intervals, the
+	// interval it belongs to may be overwritten before another finishes.
+	latest *ProcessedMetricSet
+}
+
+func newRetention(intervals int) *retention {
+	return &retention{intervals: make([]*retainedInterval, intervals)}
+}
+
+// RetainIntervals keeps the last n intervals of this MetricSystem in memory
+// so that they may be queried with Series and Percentile.  It must be
+// called before Start.
+func (ms *MetricSystem) RetainIntervals(n int) {
+	if n <= 0 {
+		ms.retention = nil
+		return
+	}
+	ms.retention = newRetention(n)
+}
+
+func (r *retention) retainRaw(rawMetrics *RawMetricSet) {
+	r.mu.Lock()
+	r.intervals[r.next] = &retainedInterval{raw: rawMetrics}
+	r.next = (r.next + 1) % len(r.intervals)
+	r.mu.Unlock()
+}
+
+func (r *retention) retainProcessed(rawMetrics *RawMetricSet,
+	processedMetrics *ProcessedMetricSet) {
+	r.mu.Lock()
+	for _, interval := range r.intervals {
+		if interval != nil && interval.raw == rawMetrics {
+			interval.processed = processedMetrics
+			break
+		}
+	}
+	// intervals may finish processing out of order
+	if r.latest == nil || !processedMetrics.Time.Before(r.latest.Time) {
+		r.latest = processedMetrics
+	}
+	r.mu.Unlock()
+}
+
+// newest returns the newest interval whose processing has completed, or nil
+// if none has.
+func (r *retention) newest() *ProcessedMetricSet {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.latest
+}
+
+// all returns every retained interval, from oldest to newest.
+func (r *retention) all() []*retainedInterval {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	retained := make([]*retainedInterval, 0, len(r.intervals))
+	for i := range r.intervals {
+		interval := r.intervals[(r.next+i)%len(r.intervals)]
+		if interval != nil {
+			retained = append(retained, &retainedInterval{
+				raw:       interval.raw,
+				processed: interval.processed,
+			})
+		}
+	}
+	return retained
+}
+
+// between returns the retained intervals stamped within [start, end], from
+// oldest to newest.
+func (r *retention) between(start, end time.Time) []*retainedInterval {
+	all := r.all()
+	retained := all[:0]
+	for _, interval := range all {
+		if !interval.raw.Time.Before(start) && !interval.raw.Time.After(end) {
+			retained = append(retained, interval)
+		}
+	}
+	return retained
+}
+
+// Series returns the processed values of a metric, such as "foo_99" or
+// "bar_rate", for each retained interval stamped within [start, end].
+// Intervals in which the metric was absent, or which are still being
+// processed, are skipped.
+func (ms *MetricSystem) Series(name string, start, end time.Time) []Point {
+	if ms.retention == nil {
+		return nil
+	}
+	var series []Point
+	for _, interval := range ms.retention.between(start, end) {
+		if interval.processed == nil {
+			continue
+		}
+		value, present := interval.processed.Metrics[name]
+		if present {
+			series = append(series, Point{Time: interval.raw.Time, Value: value})
+		}
+	}
+	return series
+}
+
+// Percentile calculates a percentile, represented as a float64 between 0
+// and 1 inclusive, of a histogram over all retained intervals stamped
+// within [start, end] by merging their buckets.
+func (ms *MetricSystem) Percentile(name string, p float64,
+	start, end time.Time) (float64, error) {
+	if ms.retention == nil {
+		return 0, fmt.Errorf("no intervals are retained")
+	}
+	retained := ms.retention.between(start, end)
+	if backend := ms.newHistogramBackend(name); backend != nil {
+		for _, interval := range retained {
+			if other, present := interval.raw.Backends[name]; present {
+				if err := backend.Merge(other); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if backend.Count() == 0 {
+			return 0, fmt.Errorf("no values of %s retained between %s and %s",
+				name, start, end)
+		}
+		return backend.Quantiles([]float64{p})[0], nil
+	}
+
+	merged := make(map[int32]uint64)
+	mapping := DefaultMapping
+	for _, interval := range retained {
+		if valuesToCounts, present := interval.raw.Histograms[name]; present {
+			mapping = interval.raw.Mapping(name)
+			for compressedValue, count := range valuesToCounts {
+				merged[compressedValue] += *count
+			}
+		}
+	}
+
+	totalCount := uint64(0)
+	proportions := make([]proportion, 0, len(merged))
+	for compressedValue, count := range merged {
+		totalCount += count
+		proportions = append(proportions, proportion{
+			Value: mapping.Value(compressedValue),
+			Count: count,
+		})
+	}
+	if totalCount == 0 {
+		return 0, fmt.Errorf("no values of %s retained between %s and %s",
+			name, start, end)
+	}
+	return percentile(totalCount, proportions, p)
+}
+
+// RecentPercentile calculates a percentile of a histogram over the retained
+// intervals that ended within the last window, such as the p99 over the
+// last 15 minutes.
+func (ms *MetricSystem) RecentPercentile(name string, p float64,
+	window time.Duration) (float64, error) {
+	now := ms.clock.Now()
+	return ms.Percentile(name, p, now.Add(-window), now)
+}
@@ -0,0 +1,76 @@
+package loghisto
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/spacejam/loghisto/clocktest"
+)
+
+func TestRetention(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.RetainIntervals(3)
+
+	for i := int64(1); i <= 4; i++ {
+		metricSystem.Counter("c", uint64(i))
+		metricSystem.Histogram("h", float64(i*100))
+		rawMetrics := metricSystem.collectRawMetrics()
+		rawMetrics.Time = time.Unix(i, 0)
+		metricSystem.retention.retainRaw(rawMetrics)
+		metricSystem.retention.retainProcessed(rawMetrics,
+			metricSystem.processMetrics(rawMetrics))
+	}
+
+	series := metricSystem.Series("c_rate", time.Unix(0, 0), time.Unix(10, 0))
+	if len(series) != 3 {
+		t.Fatalf("expected 3 retained points, got %d", len(series))
+	}
+	for i, point := range series {
+		if point.Value != float64(i+2) ||
+			!point.Time.Equal(time.Unix(int64(i+2), 0)) {
+			t.Errorf("unexpected point %d: %v", i, point)
+		}
+	}
+
+	series = metricSystem.Series("c_rate", time.Unix(3, 0), time.Unix(3, 0))
+	if len(series) != 1 || series[0].Value != 3 {
+		t.Errorf("expected a single point of 3, got %v", series)
+	}
+
+	max, err := metricSystem.Percentile("h", 1, time.Unix(0, 0),
+		time.Unix(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(max/300-1) > .01 {
+		t.Errorf("expected max of 300 over the window, got %f", max)
+	}
+
+	if _, err := metricSystem.Percentile("h", 1, time.Unix(5, 0),
+		time.Unix(6, 0)); err == nil {
+		t.Error("expected an error for a window without values")
+	}
+}
+
+func TestRecentPercentile(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(10, 0))
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetClock(clock)
+	metricSystem.RetainIntervals(10)
+
+	for _, value := range []float64{10, 1000} {
+		metricSystem.Histogram("h", value)
+		metricSystem.retention.retainRaw(metricSystem.collectRawMetrics())
+		clock.Advance(5 * time.Second)
+	}
+
+	recent, err := metricSystem.RecentPercentile("h", 0, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(recent/1000-1) > .01 {
+		t.Errorf("expected the older interval to be excluded, got min %f",
+			recent)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// GaugeRollup selects how the gauge values of several fine intervals are
+// combined into a single value for a coarser rollup interval.
+type GaugeRollup int
+
+const (
+	// GaugeLast reports the most recent value seen during the interval.
+	GaugeLast GaugeRollup = iota
+	// GaugeAvg reports the mean of the values seen during the interval.
+	GaugeAvg
+	// GaugeMax reports the largest value seen during the interval.
+	GaugeMax
+)
+
+// rollup accumulates the RawMetricSets of a finer MetricSystem until a
+// full interval of the coarser MetricSystem that owns it has been seen.
+type rollup struct {
+	interval  time.Duration
+	gaugeMode GaugeRollup
+	bucketEnd time.Time
+	counters  map[string]uint64
+	rates     map[string]uint64
+	// floatCounters and floatRates accumulate FloatCounters.
+	floatCounters map[string]float64
+	floatRates    map[string]float64
+	histograms    map[string]map[int32]*uint64
+	mappings      map[string]BucketMapping
+	backends      map[string]HistogramBackend
+	// newBackend creates empty backends for histograms that use a custom
+	// HistogramBackend, so that merging never modifies a fine interval.
+	newBackend func(name string) HistogramBackend
+	gauges     map[string]float64
+	gaugeCount map[string]int
+	exemplars  map[string]map[int32]Exemplar
+}
+
+func newRollup(interval time.Duration, gaugeMode GaugeRollup,
+	newBackend func(name string) HistogramBackend) *rollup {
+	r := &rollup{
+		interval:   interval,
+		gaugeMode:  gaugeMode,
+		newBackend: newBackend,
+	}
+	r.reset()
+	return r
+}
+
+func (r *rollup) reset() {
+	r.bucketEnd = time.Time{}
+	r.counters = make(map[string]uint64)
+	r.rates = make(map[string]uint64)
+	r.floatCounters = make(map[string]float64)
+	r.floatRates = make(map[string]float64)
+	r.histograms = make(map[string]map[int32]*uint64)
+	r.mappings = make(map[string]BucketMapping)
+	r.backends = make(map[string]HistogramBackend)
+	r.gauges = make(map[string]float64)
+	r.gaugeCount = make(map[string]int)
+	r.exemplars = make(map[string]map[int32]Exemplar)
+}
+
+// NewRollup creates a rollup tier that merges the intervals of this
+// MetricSystem into a coarser interval, which must be a multiple of this
+// MetricSystem's interval.  Counters are summed, histogram buckets are
+// added, and gauges are combined according to gaugeMode.  The tier
+// reports the percentiles, percentile errors, interpolation and rate
+// normalization configured on this MetricSystem when it is created.
+//
+// The returned MetricSystem has its own subscription channels, and may be
+// handed to NewSubmitter like any other.  It is driven by this
+// MetricSystem's reaper, so it does not need to be started, and metrics
+// recorded on it directly are ignored.
+func (ms *MetricSystem) NewRollup(interval time.Duration,
+	gaugeMode GaugeRollup) (*MetricSystem, error) {
+	if interval <= ms.interval || interval%ms.interval != 0 {
+		return nil, fmt.Errorf("rollup interval %s is not a multiple of %s",
+			interval, ms.interval)
+	}
+	tier := NewMetricSystem(interval, false)
+	tier.clock = ms.clock
+	tier.percentiles = ms.percentiles
+	tier.percentileErrors = ms.percentileErrors
+	tier.interpolatePercentiles = ms.interpolatePercentiles
+	tier.normalizeRates = ms.normalizeRates
+	tier.registry = ms.registry
+	tier.derived = ms.derived
+	tier.rollup = newRollup(interval, gaugeMode, ms.newHistogramBackend)
+
+	ms.rollupsMu.Lock()
+	ms.rollups = append(ms.rollups, tier)
+	ms.rollupsMu.Unlock()
+	return tier, nil
+}
+
+// rollupSystems returns a snapshot of the rollup tiers of this
+// MetricSystem.
+func (ms *MetricSystem) rollupSystems() []*MetricSystem {
+	ms.rollupsMu.Lock()
+	defer ms.rollupsMu.Unlock()
+	return append([]*MetricSystem(nil), ms.rollups...)
+}
+
+// merge adds a fine RawMetricSet to the current coarse interval, and
+// returns any coarse RawMetricSets that have been completed by it.
+func (r *rollup) merge(rawMetrics *RawMetricSet) []*RawMetricSet {
+	var completed []*RawMetricSet
+
+	// a RawMetricSet is stamped with the end of the interval it covers
+	if !r.bucketEnd.IsZero() && rawMetrics.Time.After(r.bucketEnd) {
+		// the interval boundary was skipped, so flush what we have
+		completed = append(completed, r.flush())
+	}
+	if r.bucketEnd.IsZero() {
+		r.bucketEnd = normalizeToInterval(rawMetrics.Time, r.interval)
+		if r.bucketEnd.Before(rawMetrics.Time) {
+			r.bucketEnd = r.bucketEnd.Add(r.interval)
+		}
+	}
+
+	for name, count := range rawMetrics.Counters {
+		r.counters[name] = count
+	}
+	for name, count := range rawMetrics.Rates {
+		r.rates[name] += count
+	}
+	for name, count := range rawMetrics.FloatCounters {
+		r.floatCounters[name] = count
+	}
+	for name, count := range rawMetrics.FloatRates {
+		r.floatRates[name] += count
+	}
+	for name, valuesToCounts := range rawMetrics.Histograms {
+		histogram, present := r.histograms[name]
+		if !present {
+			histogram = make(map[int32]*uint64)
+			r.histograms[name] = histogram
+		}
+		for compressedValue, count := range valuesToCounts {
+			if _, present := histogram[compressedValue]; !present {
+				var z uint64
+				histogram[compressedValue] = &z
+			}
+			*histogram[compressedValue] += *count
+		}
+	}
+	for name, mapping := range rawMetrics.Mappings {
+		r.mappings[name] = mapping
+	}
+	for name, backend := range rawMetrics.Backends {
+		merged, present := r.backends[name]
+		if !present {
+			if merged = r.newBackend(name); merged == nil {
+				glog.Errorf("unable to roll up histogram %s, its backend is "+
+					"no longer specified", name)
+				continue
+			}
+			r.backends[name] = merged
+		}
+		if err := merged.Merge(backend); err != nil {
+			glog.Errorf("unable to roll up histogram %s: %s", name, err)
+		}
+	}
+	for name, bucketExemplars := range rawMetrics.Exemplars {
+		merged, present := r.exemplars[name]
+		if !present {
+			merged = make(map[int32]Exemplar)
+			r.exemplars[name] = merged
+		}
+		for key, exemplar := range bucketExemplars {
+			if previous, present := merged[key]; !present ||
+				exemplar.Time.After(previous.Time) {
+				merged[key] = exemplar
+			}
+		}
+	}
+	for name, value := range rawMetrics.Gauges {
+		previous, present := r.gauges[name]
+		switch {
+		case !present:
+			r.gauges[name] = value
+		case r.gaugeMode == GaugeAvg:
+			r.gauges[name] = previous + value
+		case r.gaugeMode == GaugeMax && previous > value:
+		default:
+			r.gauges[name] = value
+		}
+		r.gaugeCount[name]++
+	}
+
+	if !rawMetrics.Time.Before(r.bucketEnd) {
+		completed = append(completed, r.flush())
+	}
+	return completed
+}
+
+// flush returns the accumulated coarse RawMetricSet and starts a new one.
+func (r *rollup) flush() *RawMetricSet {
+	gauges := r.gauges
+	if r.gaugeMode == GaugeAvg {
+		for name, count := range r.gaugeCount {
+			gauges[name] /= float64(count)
+		}
+	}
+	rawMetrics := &RawMetricSet{
+		Time:          r.bucketEnd,
+		Counters:      r.counters,
+		Rates:         r.rates,
+		FloatCounters: r.floatCounters,
+		FloatRates:    r.floatRates,
+		Histograms:    r.histograms,
+		Mappings:      r.mappings,
+		Backends:      r.backends,
+		Gauges:        gauges,
+		Exemplars:     r.exemplars,
+	}
+	r.reset()
+	return rawMetrics
+}
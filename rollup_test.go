@@ -0,0 +1,142 @@
+package loghisto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spacejam/loghisto/clocktest"
+)
+
+func TestRollupMerge(t *testing.T) {
+	r := newRollup(3*time.Second, GaugeMax, nil)
+	for i := int64(1); i <= 3; i++ {
+		fine := NewMetricSystem(time.Second, false)
+		fine.Counter("c", uint64(i))
+		fine.Histogram("h", float64(i))
+		fine.FloatCounter("f", float64(i)/2)
+		rawMetrics := fine.collectRawMetrics()
+		rawMetrics.Time = time.Unix(i, 0)
+		rawMetrics.Counters["c"] = uint64(i * 10)
+		rawMetrics.Gauges["g"] = float64(4 - i)
+
+		completed := r.merge(rawMetrics)
+		if i < 3 && len(completed) != 0 {
+			t.Fatalf("rollup completed early after %d intervals", i)
+		}
+		if i == 3 {
+			if len(completed) != 1 {
+				t.Fatalf("expected 1 completed rollup, got %d", len(completed))
+			}
+			coarse := completed[0]
+			if !coarse.Time.Equal(time.Unix(3, 0)) {
+				t.Errorf("expected rollup time %s, got %s", time.Unix(3, 0),
+					coarse.Time)
+			}
+			if coarse.Rates["c"] != 6 {
+				t.Errorf("expected summed rate of 6, got %d", coarse.Rates["c"])
+			}
+			if coarse.Counters["c"] != 30 {
+				t.Errorf("expected latest counter total of 30, got %d",
+					coarse.Counters["c"])
+			}
+			if coarse.FloatRates["f"] != 3 || coarse.FloatCounters["f"] != 1.5 {
+				t.Errorf("expected summed float rate of 3 and latest total of "+
+					"1.5, got %f and %f", coarse.FloatRates["f"],
+					coarse.FloatCounters["f"])
+			}
+			if coarse.Gauges["g"] != 3 {
+				t.Errorf("expected max gauge of 3, got %f", coarse.Gauges["g"])
+			}
+			if len(coarse.Histograms["h"]) != 3 {
+				t.Errorf("expected 3 merged histogram buckets, got %d",
+					len(coarse.Histograms["h"]))
+			}
+		}
+	}
+}
+
+func TestRollupSkippedBoundary(t *testing.T) {
+	r := newRollup(2*time.Second, GaugeAvg, nil)
+	r.merge(&RawMetricSet{
+		Time:   time.Unix(1, 0),
+		Gauges: map[string]float64{"g": 2},
+	})
+	completed := r.merge(&RawMetricSet{
+		Time:   time.Unix(3, 0),
+		Gauges: map[string]float64{"g": 4},
+	})
+	if len(completed) != 1 || !completed[0].Time.Equal(time.Unix(2, 0)) {
+		t.Fatalf("expected the interval ending at 2s to be flushed, got %v",
+			completed)
+	}
+	completed = r.merge(&RawMetricSet{
+		Time:   time.Unix(4, 0),
+		Gauges: map[string]float64{"g": 8},
+	})
+	if len(completed) != 1 || completed[0].Gauges["g"] != 6 {
+		t.Fatalf("expected averaged gauge of 6, got %v", completed)
+	}
+}
+
+func TestNewRollup(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(0, 1))
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetClock(clock)
+	if _, err := metricSystem.NewRollup(1500*time.Millisecond,
+		GaugeLast); err == nil {
+		t.Error("expected an error for an interval that is not a multiple")
+	}
+
+	tier, err := metricSystem.NewRollup(2*time.Second, GaugeLast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processedMetricStream := make(chan *ProcessedMetricSet, 4)
+	tier.SubscribeToProcessedMetrics(processedMetricStream)
+	metricSystem.Start()
+	defer metricSystem.Stop()
+
+	for i := int64(1); i <= 2; i++ {
+		metricSystem.Histogram("h", 100)
+		clock.BlockUntil(1)
+		clock.Set(time.Unix(i, 0))
+	}
+
+	select {
+	case processedMetrics := <-processedMetricStream:
+		if processedMetrics.Metrics["h_count"] != 2 {
+			t.Errorf("expected rolled up h_count of 2, got %f",
+				processedMetrics.Metrics["h_count"])
+		}
+	case <-time.After(time.Second):
+		t.Error("received no metrics from the rollup tier")
+	}
+}
+
+func TestRollupPercentileSettings(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifyPercentileErrors(PercentileBounds |
+		PercentileRelativeError)
+	metricSystem.InterpolatePercentiles(true)
+	tier, err := metricSystem.NewRollup(2*time.Second, GaugeLast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 100; i++ {
+		metricSystem.Histogram("h", float64(i))
+	}
+	rawMetrics := metricSystem.collectRawMetrics()
+	expected := metricSystem.processMetrics(rawMetrics).Metrics
+	metrics := tier.processMetrics(rawMetrics).Metrics
+	for _, name := range []string{"h_50", "h_99_lower", "h_99_upper",
+		"h_99_rel_error"} {
+		if _, present := expected[name]; !present {
+			t.Fatalf("expected %s from the parent", name)
+		}
+		if metrics[name] != expected[name] {
+			t.Errorf("expected the tier's %s to be %f, got %f", name,
+				expected[name], metrics[name])
+		}
+	}
+}
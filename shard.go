@@ -0,0 +1,259 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// shard is one stripe of the caches written to by Counter and Histogram.
+// Each call picks a shard at random, so concurrent writers rarely share a
+// lock or its cache line, and reaper merges all shards at collection time.
+type shard struct {
+	// mu controls access to counters and histograms.  Writers of existing
+	// entries only need a read lock, as they use atomic adds.
+	mu sync.RWMutex
+	// counters aggregates new Counters until they are collected by reaper().
+	counters map[string]*uint64
+	// floatCounters aggregates the bits of new FloatCounters until they are
+	// collected by reaper().
+	floatCounters map[string]*uint64
+	// histograms aggregates Histograms until they are collected by reaper().
+	histograms map[string]map[int32]*uint64
+	// pad keeps neighboring shards on separate cache lines.
+	_ [64]byte
+}
+
+// shards is a power-of-two sized set of stripes.
+type shards []shard
+
+// newShards creates at least n shards, rounded up to a power of two.
+func newShards(n int) shards {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	s := make(shards, size)
+	for i := range s {
+		s[i].counters = make(map[string]*uint64)
+		s[i].floatCounters = make(map[string]*uint64)
+		s[i].histograms = make(map[string]map[int32]*uint64)
+	}
+	return s
+}
+
+// defaultShardCount stripes the caches across twice as many shards as there
+// are processors to run writers on.
+func defaultShardCount() int {
+	return 2 * runtime.GOMAXPROCS(0)
+}
+
+// pick returns a shard for the calling goroutine by hashing the address of
+// its stack, which differs between goroutines and is usually stable for
+// each of them.  Unlike a random or round-robin choice, this reads no
+// shared state at all, so it introduces neither a lock nor a shared cache
+// line of its own, and a goroutine tends to keep writing to the same shard.
+func (s shards) pick() *shard {
+	if len(s) == 1 {
+		return &s[0]
+	}
+	var local byte
+	// Fibonacci hashing spreads stacks, which are aligned to at least 1KB,
+	// across the shards
+	stack := uint64(uintptr(unsafe.Pointer(&local)) >> 10)
+	return &s[(stack*0x9E3779B97F4A7C15)>>32&uint64(len(s)-1)]
+}
+
+// counter adds amount to a Counter in this shard.
+func (s *shard) counter(name string, amount uint64) {
+	s.mu.RLock()
+	count, exists := s.counters[name]
+	// perform lock promotion when we need more control
+	if exists {
+		atomic.AddUint64(count, amount)
+		s.mu.RUnlock()
+		return
+	}
+	s.mu.RUnlock()
+	s.mu.Lock()
+	count, syncExists := s.counters[name]
+	if !syncExists {
+		count = new(uint64)
+		s.counters[name] = count
+	}
+	atomic.AddUint64(count, amount)
+	s.mu.Unlock()
+}
+
+// floatCounter adds amount to a FloatCounter in this shard.
+func (s *shard) floatCounter(name string, amount float64) {
+	s.mu.RLock()
+	bits, exists := s.floatCounters[name]
+	if exists {
+		addFloat64(bits, amount)
+		s.mu.RUnlock()
+		return
+	}
+	s.mu.RUnlock()
+	s.mu.Lock()
+	bits, syncExists := s.floatCounters[name]
+	if !syncExists {
+		bits = new(uint64)
+		s.floatCounters[name] = bits
+	}
+	addFloat64(bits, amount)
+	s.mu.Unlock()
+}
+
+// histogram counts a value of a Histogram in the bucket compressedValue of
+// this shard.
+func (s *shard) histogram(name string, compressedValue int32) {
+	s.mu.RLock()
+	count, present := s.histograms[name][compressedValue]
+	if present {
+		atomic.AddUint64(count, 1)
+		s.mu.RUnlock()
+		return
+	}
+	s.mu.RUnlock()
+	s.mu.Lock()
+	count, syncPresent := s.histograms[name][compressedValue]
+	if !syncPresent {
+		_, mapPresent := s.histograms[name]
+		if !mapPresent {
+			s.histograms[name] = make(map[int32]*uint64)
+		}
+		count = new(uint64)
+		s.histograms[name][compressedValue] = count
+	}
+	atomic.AddUint64(count, 1)
+	s.mu.Unlock()
+}
+
+// collect swaps out the caches of every shard and merges them.
+func (s shards) collect() (counters map[string]*uint64,
+	floatCounters map[string]float64,
+	histograms map[string]map[int32]*uint64) {
+	counters = make(map[string]*uint64)
+	floatCounters = make(map[string]float64)
+	histograms = make(map[string]map[int32]*uint64)
+	for i := range s {
+		s[i].mu.Lock()
+		shardCounters, shardHistograms := s[i].counters, s[i].histograms
+		shardFloatCounters := s[i].floatCounters
+		s[i].counters = make(map[string]*uint64)
+		s[i].floatCounters = make(map[string]*uint64)
+		s[i].histograms = make(map[string]map[int32]*uint64)
+		s[i].mu.Unlock()
+
+		// no writer can reach the swapped out maps any longer
+		for name, count := range shardCounters {
+			if total, present := counters[name]; present {
+				*total += *count
+			} else {
+				counters[name] = count
+			}
+		}
+		for name, bits := range shardFloatCounters {
+			floatCounters[name] += math.Float64frombits(*bits)
+		}
+		for name, valuesToCounts := range shardHistograms {
+			merged, present := histograms[name]
+			if !present {
+				histograms[name] = valuesToCounts
+				continue
+			}
+			for compressedValue, count := range valuesToCounts {
+				if total, present := merged[compressedValue]; present {
+					*total += *count
+				} else {
+					merged[compressedValue] = count
+				}
+			}
+		}
+	}
+	return counters, floatCounters, histograms
+}
+
+// peek returns the bucket counts of a histogram recorded in the shards
+// since the last collection, without collecting them.
+func (s shards) peek(name string) map[int32]uint64 {
+	counts := make(map[int32]uint64)
+	for i := range s {
+		s[i].mu.RLock()
+		for compressedValue, count := range s[i].histograms[name] {
+			counts[compressedValue] += atomic.LoadUint64(count)
+		}
+		s[i].mu.RUnlock()
+	}
+	return counts
+}
+
+// histogramSettings is an immutable snapshot of the per-histogram settings
+// of a MetricSystem.  It is replaced wholesale when a setting changes, so
+// that Histogram may read it without taking a lock.
+type histogramSettings struct {
+	// mappings holds histograms that do not use DefaultMapping.
+	mappings map[string]BucketMapping
+	// backends creates backends for histograms that use a custom
+	// HistogramBackend.
+	backends map[string]func() HistogramBackend
+}
+
+// loadHistogramSettings returns the current per-histogram settings.
+func (ms *MetricSystem) loadHistogramSettings() *histogramSettings {
+	return ms.histogramSettings.Load().(*histogramSettings)
+}
+
+// updateHistogramSettings applies update to a copy of the per-histogram
+// settings and publishes the copy.
+func (ms *MetricSystem) updateHistogramSettings(
+	update func(*histogramSettings)) {
+	ms.histogramSettingsMu.Lock()
+	defer ms.histogramSettingsMu.Unlock()
+	current := ms.loadHistogramSettings()
+	next := &histogramSettings{
+		mappings: make(map[string]BucketMapping, len(current.mappings)),
+		backends: make(map[string]func() HistogramBackend,
+			len(current.backends)),
+	}
+	for name, mapping := range current.mappings {
+		next.mappings[name] = mapping
+	}
+	for name, newBackend := range current.backends {
+		next.backends[name] = newBackend
+	}
+	update(next)
+	ms.histogramSettings.Store(next)
+}
+
+// mapping returns the mapping of a histogram.
+func (hs *histogramSettings) mapping(name string) BucketMapping {
+	if len(hs.mappings) == 0 {
+		return DefaultMapping
+	}
+	mapping, present := hs.mappings[name]
+	if !present {
+		return DefaultMapping
+	}
+	return mapping
+}
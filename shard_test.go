@@ -0,0 +1,126 @@
+package loghisto
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardsCollect(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.shards = newShards(8)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				metricSystem.Counter("c", 2)
+				metricSystem.Histogram("h", 100)
+				metricSystem.Histogram("h", 200)
+			}
+		}()
+	}
+	wg.Wait()
+
+	rawMetrics := metricSystem.collectRawMetrics()
+	if rawMetrics.Rates["c"] != 128000 {
+		t.Errorf("expected merged rate of 128000, got %d", rawMetrics.Rates["c"])
+	}
+	if len(rawMetrics.Histograms["h"]) != 2 {
+		t.Fatalf("expected 2 merged buckets, got %d",
+			len(rawMetrics.Histograms["h"]))
+	}
+	for compressedValue, count := range rawMetrics.Histograms["h"] {
+		if *count != 64000 {
+			t.Errorf("expected 64000 values in bucket %d, got %d",
+				compressedValue, *count)
+		}
+	}
+
+	rawMetrics = metricSystem.collectRawMetrics()
+	if len(rawMetrics.Rates) != 0 || len(rawMetrics.Histograms) != 0 {
+		t.Error("expected shards to be emptied by collection")
+	}
+}
+
+func TestNewShards(t *testing.T) {
+	for n, expected := range map[int]int{0: 1, 1: 1, 3: 4, 64: 64, 65: 128} {
+		if size := len(newShards(n)); size != expected {
+			t.Errorf("newShards(%d): expected %d shards, got %d", n, expected,
+				size)
+		}
+	}
+}
+
+// benchmarkParallel splits b.N calls of op across a number of goroutines.
+func benchmarkParallel(b *testing.B, goroutines int, op func()) {
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for g := 0; g < goroutines; g++ {
+		n := b.N / goroutines
+		if g < b.N%goroutines {
+			n++
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				op()
+			}
+		}(n)
+	}
+	wg.Wait()
+}
+
+// benchmarkSharding compares a single shard, equivalent to a global lock,
+// with the default striping as the number of writers grows.
+func benchmarkSharding(b *testing.B, op func(*MetricSystem)) {
+	for _, shardCount := range []int{1, defaultShardCount()} {
+		for _, goroutines := range []int{1, 8, 64, 256} {
+			b.Run(fmt.Sprintf("shards=%d/goroutines=%d", shardCount, goroutines),
+				func(b *testing.B) {
+					metricSystem := NewMetricSystem(time.Minute, false)
+					metricSystem.shards = newShards(shardCount)
+					benchmarkParallel(b, goroutines, func() { op(metricSystem) })
+				})
+		}
+	}
+}
+
+func BenchmarkCounter(b *testing.B) {
+	benchmarkSharding(b, func(ms *MetricSystem) {
+		ms.Counter("benchmark_counter", 1)
+	})
+}
+
+func BenchmarkHistogram(b *testing.B) {
+	benchmarkSharding(b, func(ms *MetricSystem) {
+		ms.Histogram("benchmark_histogram", 12345)
+	})
+}
+
+func TestShardsPickSpreads(t *testing.T) {
+	s := newShards(16)
+	picked := make(chan *shard, 256)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(picked); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			picked <- s.pick()
+		}()
+	}
+	wg.Wait()
+	close(picked)
+	distinct := make(map[*shard]struct{})
+	for shard := range picked {
+		distinct[shard] = struct{}{}
+	}
+	if len(distinct) < len(s)/2 {
+		t.Errorf("expected goroutines to spread across the shards, got %d of %d",
+			len(distinct), len(s))
+	}
+}
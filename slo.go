@@ -0,0 +1,246 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultBurnRateWindows are the windows over which burn rates are
+// reported for SLOs that do not specify any, pairing short windows that
+// detect fast burns with long ones that detect slow burns.
+var DefaultBurnRateWindows = []time.Duration{
+	5 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	3 * 24 * time.Hour,
+}
+
+// SLO is a service level objective over a histogram, such as 99% of
+// rpc_latency under 200ms over 30 days:
+//
+//	SLO{
+//		Name:      "rpc_latency_slo",
+//		Histogram: "rpc_latency",
+//		Threshold: float64(200 * time.Millisecond),
+//		Objective: 0.99,
+//		Window:    30 * 24 * time.Hour,
+//	}
+//
+// A value is good if its whole bucket lies at or below Threshold, so the
+// good fraction is exact at the granularity of the histogram's
+// BucketMapping, and a bucket straddling Threshold is counted as bad.
+type SLO struct {
+	// Name prefixes the gauges reported for the SLO.
+	Name string
+	// Histogram is the name of a histogram that uses a BucketMapping.
+	Histogram string
+	// Threshold is the highest good value.
+	Threshold float64
+	// Objective is the fraction of values that should be good, between 0
+	// and 1 exclusive.
+	Objective float64
+	// Window is the duration the objective applies to.
+	Window time.Duration
+	// BurnRateWindows are the windows over which burn rates are reported,
+	// or DefaultBurnRateWindows if nil.  Windows longer than Window are
+	// ignored.
+	BurnRateWindows []time.Duration
+}
+
+// sloCounts are the good and total values of an SLO's histogram in an
+// interval.
+type sloCounts struct {
+	good, total uint64
+}
+
+// sloTracker is a ring of the counts of an SLO in the intervals of its
+// window.
+type sloTracker struct {
+	slo  SLO
+	ring []sloCounts
+	// next is the position in ring that will be overwritten next.
+	next int
+	// window holds the sum of ring.
+	window sloCounts
+	// burnRateIntervals is the number of intervals of each burn rate window,
+	// and burnRateLabels their gauge names.
+	burnRateIntervals []int
+	burnRateLabels    []string
+}
+
+// windowIntervals rounds a window up to a whole number of intervals.
+func (ms *MetricSystem) windowIntervals(window time.Duration) int {
+	intervals := int((window + ms.interval - 1) / ms.interval)
+	if intervals < 1 {
+		intervals = 1
+	}
+	return intervals
+}
+
+// formatWindow abbreviates a window in its largest whole unit, such as 5m
+// or 3d.
+func formatWindow(window time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case window%day == 0:
+		return fmt.Sprintf("%dd", window/day)
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	case window%time.Second == 0:
+		return fmt.Sprintf("%ds", window/time.Second)
+	}
+	return window.String()
+}
+
+// AddSLO tracks a service level objective, reporting these gauges at each
+// interval, over the window of the SLO unless noted:
+//
+//	<name>_good                    the number of good values
+//	<name>_total                   the number of values
+//	<name>_error_budget_remaining  the fraction of the allowed bad values
+//	                               not yet spent, negative once overspent
+//	<name>_burn_rate_<window>      the rate at which bad values spent the
+//	                               error budget over each burn rate window,
+//	                               where 1 spends it exactly over the
+//	                               window of the SLO
+//
+// Windows are rounded up to a whole number of intervals, and memory grows
+// with the number of intervals in the window of the SLO.  Adding an SLO
+// under an existing name replaces it, discarding its counts.
+func (ms *MetricSystem) AddSLO(slo SLO) error {
+	if slo.Name == "" || slo.Histogram == "" {
+		return errors.New("an SLO needs a name and a histogram")
+	}
+	if slo.Objective <= 0 || slo.Objective >= 1 {
+		return fmt.Errorf("SLO %s has objective %g, which is not between 0 "+
+			"and 1 exclusive", slo.Name, slo.Objective)
+	}
+	if slo.Window <= 0 {
+		return fmt.Errorf("SLO %s has no window", slo.Name)
+	}
+	burnRateWindows := slo.BurnRateWindows
+	if burnRateWindows == nil {
+		burnRateWindows = DefaultBurnRateWindows
+	}
+	burnRateWindows = append([]time.Duration(nil), burnRateWindows...)
+	sort.Slice(burnRateWindows, func(i, j int) bool {
+		return burnRateWindows[i] < burnRateWindows[j]
+	})
+
+	tracker := &sloTracker{
+		slo:  slo,
+		ring: make([]sloCounts, ms.windowIntervals(slo.Window)),
+	}
+	for _, window := range burnRateWindows {
+		if window > slo.Window || window <= 0 {
+			continue
+		}
+		tracker.burnRateIntervals = append(tracker.burnRateIntervals,
+			ms.windowIntervals(window))
+		tracker.burnRateLabels = append(tracker.burnRateLabels,
+			fmt.Sprintf("%s_burn_rate_%s", slo.Name, formatWindow(window)))
+	}
+
+	ms.slosMu.Lock()
+	ms.slos[slo.Name] = tracker
+	ms.slosMu.Unlock()
+	return nil
+}
+
+// RemoveSLO stops tracking an SLO.
+func (ms *MetricSystem) RemoveSLO(name string) {
+	ms.slosMu.Lock()
+	delete(ms.slos, name)
+	ms.slosMu.Unlock()
+}
+
+// goodCounts counts the good and total values of an interval's histogram.
+func (slo *SLO) goodCounts(valuesToCounts map[int32]*uint64,
+	mapping BucketMapping) sloCounts {
+	var counts sloCounts
+	for key, count := range valuesToCounts {
+		counts.total += *count
+		if _, upper := mapping.Bounds(key); upper <= slo.Threshold {
+			counts.good += *count
+		}
+	}
+	return counts
+}
+
+// add records the counts of an interval, evicting the oldest interval.
+func (t *sloTracker) add(counts sloCounts) {
+	evicted := t.ring[t.next]
+	t.window.good += counts.good - evicted.good
+	t.window.total += counts.total - evicted.total
+	t.ring[t.next] = counts
+	t.next = (t.next + 1) % len(t.ring)
+}
+
+// recent sums the counts of the latest intervals.
+func (t *sloTracker) recent(intervals int) sloCounts {
+	var sum sloCounts
+	for i := 1; i <= intervals && i <= len(t.ring); i++ {
+		counts := t.ring[(t.next-i+len(t.ring))%len(t.ring)]
+		sum.good += counts.good
+		sum.total += counts.total
+	}
+	return sum
+}
+
+// burnRate is the bad fraction of counts relative to the error budget.
+func (t *sloTracker) burnRate(counts sloCounts) float64 {
+	if counts.total == 0 {
+		return 0
+	}
+	bad := float64(counts.total-counts.good) / float64(counts.total)
+	return bad / (1 - t.slo.Objective)
+}
+
+// collectSLOs adds the counts of an interval's histograms to every SLO,
+// and reports the gauges of each SLO.
+func (ms *MetricSystem) collectSLOs(
+	histograms map[string]map[int32]*uint64, gauges map[string]float64) {
+	ms.slosMu.Lock()
+	defer ms.slosMu.Unlock()
+	if len(ms.slos) == 0 {
+		return
+	}
+	settings := ms.loadHistogramSettings()
+	for name, t := range ms.slos {
+		var counts sloCounts
+		if valuesToCounts, present := histograms[t.slo.Histogram]; present {
+			counts = t.slo.goodCounts(valuesToCounts,
+				settings.mapping(t.slo.Histogram))
+		}
+		t.add(counts)
+
+		gauges[name+"_good"] = float64(t.window.good)
+		gauges[name+"_total"] = float64(t.window.total)
+		gauges[name+"_error_budget_remaining"] = 1 - t.burnRate(t.window)
+		for i, intervals := range t.burnRateIntervals {
+			gauges[t.burnRateLabels[i]] = t.burnRate(t.recent(intervals))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package loghisto
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSLO(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Minute, false)
+	metricSystem.SpecifyHistogramMapping("latency", NewHDRMapping(3))
+	err := metricSystem.AddSLO(SLO{
+		Name:            "latency_slo",
+		Histogram:       "latency",
+		Threshold:       200,
+		Objective:       0.9,
+		Window:          10 * time.Minute,
+		BurnRateWindows: []time.Duration{2 * time.Minute, time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 intervals of 10 good values
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10; j++ {
+			metricSystem.Histogram("latency", 100)
+		}
+		metricSystem.collectRawMetrics()
+	}
+	// 1 interval of 8 good and 2 bad values, including one in a bucket
+	// straddling the threshold
+	for j := 0; j < 8; j++ {
+		metricSystem.Histogram("latency", 199)
+	}
+	metricSystem.Histogram("latency", 200.5)
+	metricSystem.Histogram("latency", 1000)
+	gauges := metricSystem.collectRawMetrics().Gauges
+
+	expected := map[string]float64{
+		"latency_slo_good":  58,
+		"latency_slo_total": 60,
+		// 2 bad values spend 2 / 6 of the budget of 6
+		"latency_slo_error_budget_remaining": 1 - 2.0/6,
+		// 2 of 20 values are bad, the same as the objective
+		"latency_slo_burn_rate_2m": 1,
+	}
+	for name, value := range expected {
+		if v, present := gauges[name]; !present || math.Abs(v-value) > 1e-9 {
+			t.Errorf("expected %s to be %f, got %f", name, value, v)
+		}
+	}
+	if _, present := gauges["latency_slo_burn_rate_1h"]; present {
+		t.Error("expected burn rate windows longer than the SLO to be ignored")
+	}
+
+	// after the window passes, only empty intervals remain
+	for i := 0; i < 10; i++ {
+		gauges = metricSystem.collectRawMetrics().Gauges
+	}
+	if gauges["latency_slo_total"] != 0 ||
+		gauges["latency_slo_error_budget_remaining"] != 1 ||
+		gauges["latency_slo_burn_rate_2m"] != 0 {
+		t.Errorf("expected the window to be empty, got %v", gauges)
+	}
+
+	metricSystem.RemoveSLO("latency_slo")
+	if gauges := metricSystem.collectRawMetrics().Gauges; len(gauges) != 0 {
+		t.Errorf("expected no gauges after removing the SLO, got %v", gauges)
+	}
+}
+
+func TestSLOCardinalityLimit(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Minute, false)
+	metricSystem.SetCardinalityLimit(1)
+	err := metricSystem.AddSLO(SLO{
+		Name:      "latency_slo",
+		Histogram: "latency",
+		Threshold: 200,
+		Objective: 0.9,
+		Window:    10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metricSystem.Histogram("latency", 100)
+	rawMetrics := metricSystem.collectRawMetrics()
+	if rawMetrics.Gauges["latency_slo_total"] != 1 {
+		t.Errorf("expected the SLO gauges to be reported, got %v",
+			rawMetrics.Gauges)
+	}
+	if len(rawMetrics.Histograms["latency"]) != 1 ||
+		rawMetrics.Counters[RejectedNamesMetric] != 0 {
+		t.Errorf("expected SLO gauges not to count towards the limit, got %v",
+			rawMetrics)
+	}
+}
+
+func TestInvalidSLO(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Minute, false)
+	for _, slo := range []SLO{
+		{Histogram: "latency", Objective: 0.9, Window: time.Hour},
+		{Name: "slo", Objective: 0.9, Window: time.Hour},
+		{Name: "slo", Histogram: "latency", Objective: 1, Window: time.Hour},
+		{Name: "slo", Histogram: "latency", Objective: 0.9},
+	} {
+		if err := metricSystem.AddSLO(slo); err == nil {
+			t.Errorf("expected an error adding %+v", slo)
+		}
+	}
+}
+
+func TestFormatWindow(t *testing.T) {
+	for window, expected := range map[time.Duration]string{
+		72 * time.Hour:          "3d",
+		6 * time.Hour:           "6h",
+		90 * time.Minute:        "90m",
+		30 * time.Second:        "30s",
+		1500 * time.Millisecond: "1.5s",
+	} {
+		if label := formatWindow(window); label != expected {
+			t.Errorf("expected %s to format as %s, got %s", window, expected,
+				label)
+		}
+	}
+}
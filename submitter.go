@@ -140,9 +140,9 @@ func (s *Submitter) Start() {
 				return
 			default:
 				s.retryBacklog()
-				tts := s.metricSystem.interval.Nanoseconds() -
-					(time.Now().UnixNano() % s.metricSystem.interval.Nanoseconds())
-				time.Sleep(time.Duration(tts))
+				tts := timeUntilNextInterval(s.metricSystem.clock.Now(),
+					s.metricSystem.interval)
+				<-s.metricSystem.clock.After(tts)
 			}
 		}
 	}()
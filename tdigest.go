@@ -0,0 +1,237 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// centroid is a cluster of values of a TDigest, summarized by their mean.
+type centroid struct {
+	Mean  float64
+	Count float64
+}
+
+// centroidArray is a sortable collection of centroids.
+type centroidArray []centroid
+
+// These next 3 methods are for the implementation of sort.Interface
+
+func (s centroidArray) Len() int {
+	return len(s)
+}
+
+func (s centroidArray) Less(i, j int) bool {
+	return s[i].Mean < s[j].Mean
+}
+
+func (s centroidArray) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// TDigest is a merging t-digest, a HistogramBackend whose memory use is
+// bounded by its compression regardless of the range of values.  It is
+// most accurate near the extreme quantiles, and its accuracy does not
+// depend on the magnitude of the values recorded.
+type TDigest struct {
+	compression float64
+	centroids   centroidArray
+	// unmerged buffers recorded values until the next compression.
+	unmerged centroidArray
+	count    float64
+	sum      float64
+	min      float64
+	max      float64
+}
+
+// NewTDigest creates an empty TDigest.  Compression bounds the number of
+// centroids kept, with 100 being a reasonable default.
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// Record implements HistogramBackend.
+func (t *TDigest) Record(value float64) {
+	t.add(centroid{Mean: value, Count: 1})
+}
+
+func (t *TDigest) add(c centroid) {
+	t.unmerged = append(t.unmerged, c)
+	t.count += c.Count
+	t.sum += c.Mean * c.Count
+	t.min = math.Min(t.min, c.Mean)
+	t.max = math.Max(t.max, c.Mean)
+	if len(t.unmerged) >= int(8*t.compression) {
+		t.centroids = t.merged()
+		t.unmerged = t.unmerged[:0]
+	}
+}
+
+// merged returns the centroids of the digest with any unmerged values
+// folded in, without modifying the digest.
+func (t *TDigest) merged() centroidArray {
+	all := make(centroidArray, 0, len(t.centroids)+len(t.unmerged))
+	all = append(all, t.centroids...)
+	all = append(all, t.unmerged...)
+	if len(all) == 0 {
+		return all
+	}
+	sort.Sort(all)
+
+	result := make(centroidArray, 0, int(t.compression))
+	current := all[0]
+	sofar := 0.0
+	limit := t.count * t.quantileLimit(0)
+	for _, c := range all[1:] {
+		if sofar+current.Count+c.Count <= limit {
+			current.Mean += (c.Mean - current.Mean) * c.Count /
+				(current.Count + c.Count)
+			current.Count += c.Count
+			continue
+		}
+		sofar += current.Count
+		result = append(result, current)
+		limit = t.count * t.quantileLimit(sofar/t.count)
+		current = c
+	}
+	return append(result, current)
+}
+
+// quantileLimit returns the largest quantile that a centroid beginning at
+// quantile q may reach, using the arcsine scale function k1, which keeps
+// centroids small near the tails.
+func (t *TDigest) quantileLimit(q float64) float64 {
+	k := t.compression / (2 * math.Pi) * math.Asin(2*q-1)
+	next := math.Sin((k+1)*2*math.Pi/t.compression)/2 + .5
+	if k+1 >= t.compression/4 {
+		return 1
+	}
+	return next
+}
+
+// Merge implements HistogramBackend.
+func (t *TDigest) Merge(other HistogramBackend) error {
+	o, ok := other.(*TDigest)
+	if !ok {
+		return fmt.Errorf("cannot merge %T into a TDigest", other)
+	}
+	for _, c := range o.centroids {
+		t.add(c)
+	}
+	for _, c := range o.unmerged {
+		t.add(c)
+	}
+	// the means of o's centroids lie within its exact extremes
+	t.min = math.Min(t.min, o.min)
+	t.max = math.Max(t.max, o.max)
+	return nil
+}
+
+// Quantiles implements HistogramBackend by interpolating between the
+// means of neighboring centroids.
+func (t *TDigest) Quantiles(qs []float64) []float64 {
+	centroids := t.merged()
+	values := make([]float64, len(qs))
+	for i, q := range qs {
+		values[i] = t.quantile(centroids, q)
+	}
+	return values
+}
+
+func (t *TDigest) quantile(centroids centroidArray, q float64) float64 {
+	if len(centroids) == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return t.min
+	}
+	if q >= 1 {
+		return t.max
+	}
+	rank := q * t.count
+	// each centroid's mean is treated as sitting at the middle of its rank
+	sofar := 0.0
+	previousMean, previousRank := t.min, 0.0
+	for _, c := range centroids {
+		middle := sofar + c.Count/2
+		if rank < middle {
+			return previousMean + (c.Mean-previousMean)*
+				(rank-previousRank)/(middle-previousRank)
+		}
+		sofar += c.Count
+		previousMean, previousRank = c.Mean, middle
+	}
+	return previousMean + (t.max-previousMean)*
+		(rank-previousRank)/(t.count-previousRank)
+}
+
+// Count implements HistogramBackend.
+func (t *TDigest) Count() uint64 {
+	return uint64(t.count)
+}
+
+// Sum implements HistogramBackend.
+func (t *TDigest) Sum() float64 {
+	return t.sum
+}
+
+// Encode implements HistogramBackend.  The encoding is the compression,
+// minimum and maximum as 8 byte floats, followed by the mean and count of
+// each centroid as 8 byte floats.
+func (t *TDigest) Encode() []byte {
+	centroids := t.merged()
+	buf := make([]byte, 8*(3+2*len(centroids)))
+	binary.BigEndian.PutUint64(buf[0:], math.Float64bits(t.compression))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(t.min))
+	binary.BigEndian.PutUint64(buf[16:], math.Float64bits(t.max))
+	for i, c := range centroids {
+		offset := 24 + 16*i
+		binary.BigEndian.PutUint64(buf[offset:], math.Float64bits(c.Mean))
+		binary.BigEndian.PutUint64(buf[offset+8:], math.Float64bits(c.Count))
+	}
+	return buf
+}
+
+// DecodeTDigest reverses TDigest.Encode.
+func DecodeTDigest(data []byte) (*TDigest, error) {
+	if len(data) < 24 || (len(data)-24)%16 != 0 {
+		return nil, errors.New("encoded TDigest has an invalid length")
+	}
+	t := NewTDigest(math.Float64frombits(binary.BigEndian.Uint64(data)))
+	min := math.Float64frombits(binary.BigEndian.Uint64(data[8:]))
+	max := math.Float64frombits(binary.BigEndian.Uint64(data[16:]))
+	for offset := 24; offset < len(data); offset += 16 {
+		c := centroid{
+			Mean:  math.Float64frombits(binary.BigEndian.Uint64(data[offset:])),
+			Count: math.Float64frombits(binary.BigEndian.Uint64(data[offset+8:])),
+		}
+		t.centroids = append(t.centroids, c)
+		t.count += c.Count
+		t.sum += c.Mean * c.Count
+	}
+	t.min, t.max = min, max
+	return t, nil
+}
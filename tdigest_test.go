@@ -0,0 +1,89 @@
+package loghisto
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestTDigestQuantiles(t *testing.T) {
+	digest := NewTDigest(100)
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 100000; i++ {
+		digest.Record(r.Float64())
+	}
+	qs := []float64{0, .01, .25, .5, .75, .99, .999, 1}
+	for i, value := range digest.Quantiles(qs) {
+		if math.Abs(value-qs[i]) > .01 {
+			t.Errorf("quantile %g of a uniform distribution was %g", qs[i],
+				value)
+		}
+	}
+	if len(digest.merged()) > 200 {
+		t.Errorf("expected compression to bound centroids, got %d",
+			len(digest.merged()))
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	low, high := NewTDigest(100), NewTDigest(100)
+	for i := 0; i < 1000; i++ {
+		low.Record(float64(i))
+		high.Record(float64(i + 1000))
+	}
+	if err := low.Merge(high); err != nil {
+		t.Fatal(err)
+	}
+	if low.Count() != 2000 {
+		t.Errorf("expected a merged count of 2000, got %d", low.Count())
+	}
+	median := low.Quantiles([]float64{.5})[0]
+	if math.Abs(median-1000) > 20 {
+		t.Errorf("expected a merged median near 1000, got %f", median)
+	}
+	if high.Count() != 1000 {
+		t.Error("merging must not modify its argument")
+	}
+
+	// the extremes survive merging compressed centroids into an empty digest
+	large, merged := NewTDigest(100), NewTDigest(100)
+	for i := 1; i <= 100000; i++ {
+		large.Record(float64(i))
+	}
+	if err := merged.Merge(large); err != nil {
+		t.Fatal(err)
+	}
+	extremes := merged.Quantiles([]float64{0, 1})
+	if extremes[0] != 1 || extremes[1] != 100000 {
+		t.Errorf("expected a merged min of 1 and max of 100000, got %v",
+			extremes)
+	}
+	if err := low.Merge(NewBucketHistogram(DefaultMapping)); err == nil {
+		t.Error("expected an error merging a BucketHistogram into a TDigest")
+	}
+}
+
+func TestTDigestEncode(t *testing.T) {
+	digest := NewTDigest(50)
+	for i := 0; i < 5000; i++ {
+		digest.Record(float64(i))
+	}
+	decoded, err := DecodeTDigest(digest.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs := []float64{0, .5, .99, 1}
+	expected, actual := digest.Quantiles(qs), decoded.Quantiles(qs)
+	for i := range qs {
+		if math.Abs(expected[i]-actual[i]) > 1e-9 {
+			t.Errorf("quantile %g: expected %f, got %f", qs[i], expected[i],
+				actual[i])
+		}
+	}
+	if decoded.Count() != digest.Count() {
+		t.Errorf("expected count %d, got %d", digest.Count(), decoded.Count())
+	}
+	if _, err := DecodeTDigest(make([]byte, 25)); err == nil {
+		t.Error("expected an error decoding an invalid TDigest")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// timerKey is the context key of the TimerToken started by TimeCtx or
+// WithTimer.
+type timerKey struct{}
+
+// StopAs stops a timer like Stop, but submits its duration under name
+// rather than the name the timer was started with.
+func (tt *TimerToken) StopAs(name string) time.Duration {
+	return tt.StopAsWithUnit(name, time.Nanosecond)
+}
+
+// StopWithUnit stops a timer like Stop, but submits its duration as a
+// number of units, such as time.Microsecond or time.Millisecond, rather
+// than nanoseconds.
+func (tt *TimerToken) StopWithUnit(unit time.Duration) time.Duration {
+	return tt.StopAsWithUnit(tt.Name, unit)
+}
+
+// StopAsWithUnit stops a timer, submits a Histogram of its duration under
+// name as a number of units, and returns its duration.
+func (tt *TimerToken) StopAsWithUnit(name string,
+	unit time.Duration) time.Duration {
+	duration := tt.MetricSystem.clock.Now().Sub(tt.Start)
+	tt.MetricSystem.Histogram(name, float64(duration)/float64(unit))
+	return duration
+}
+
+// Time runs f, submits a Histogram of its duration in nanoseconds under
+// name, and returns its duration.
+func (ms *MetricSystem) Time(name string, f func()) time.Duration {
+	token := ms.StartTimer(name)
+	f()
+	return token.Stop()
+}
+
+// TimeCtx runs f with a context carrying its timer, which may be retrieved
+// with TimerFromContext, and returns the error of f.  The duration of f is
+// submitted in nanoseconds as a Histogram named <name>_success if f
+// returns nil and <name>_error otherwise.
+func (ms *MetricSystem) TimeCtx(ctx context.Context, name string,
+	f func(context.Context) error) error {
+	ctx = ms.WithTimer(ctx, name)
+	token, _ := TimerFromContext(ctx)
+	err := f(ctx)
+	if err != nil {
+		token.StopAs(fmt.Sprintf("%s_error", name))
+	} else {
+		token.StopAs(fmt.Sprintf("%s_success", name))
+	}
+	return err
+}
+
+// WithTimer starts a timer and returns a context carrying it, so that the
+// timer need not be passed down a call chain by hand.  It is stopped by
+// retrieving it with TimerFromContext.
+func (ms *MetricSystem) WithTimer(ctx context.Context,
+	name string) context.Context {
+	token := ms.StartTimer(name)
+	return context.WithValue(ctx, timerKey{}, &token)
+}
+
+// TimerFromContext returns the timer carried by a context created by
+// WithTimer or TimeCtx.
+func TimerFromContext(ctx context.Context) (*TimerToken, bool) {
+	token, ok := ctx.Value(timerKey{}).(*TimerToken)
+	return token, ok
+}
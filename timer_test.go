@@ -0,0 +1,91 @@
+package loghisto
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spacejam/loghisto/clocktest"
+)
+
+func TestStopVariants(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(0, 0))
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetClock(clock)
+
+	micros := metricSystem.StartTimer("rpc")
+	millis := metricSystem.StartTimer("rpc")
+	renamed := metricSystem.StartTimer("rpc")
+	clock.Advance(1500 * time.Microsecond)
+	micros.StopWithUnit(time.Microsecond)
+	millis.StopAsWithUnit("rpc_ms", time.Millisecond)
+	if d := renamed.StopAs("rpc_renamed"); d != 1500*time.Microsecond {
+		t.Errorf("expected a duration of 1.5ms, got %s", d)
+	}
+
+	metrics := metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	for name, expected := range map[string]float64{
+		"rpc_max":         1500,
+		"rpc_ms_max":      1.5,
+		"rpc_renamed_max": 1500000,
+	} {
+		if v := metrics[name]; v < expected*.99 || v > expected*1.01 {
+			t.Errorf("expected %s near %f, got %f", name, expected, v)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(0, 0))
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetClock(clock)
+
+	d := metricSystem.Time("work", func() {
+		clock.Advance(time.Millisecond)
+	})
+	if d != time.Millisecond {
+		t.Errorf("expected a duration of 1ms, got %s", d)
+	}
+	if _, present := metricSystem.collectRawMetrics().Histograms["work"]; !present {
+		t.Error("expected a work histogram")
+	}
+}
+
+func TestTimeCtx(t *testing.T) {
+	clock := clocktest.NewClock(time.Unix(0, 0))
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SetClock(clock)
+
+	err := metricSystem.TimeCtx(context.Background(), "rpc",
+		func(ctx context.Context) error {
+			token, ok := TimerFromContext(ctx)
+			if !ok || token.Name != "rpc" {
+				t.Error("expected the context to carry the timer")
+			}
+			clock.Advance(time.Millisecond)
+			return nil
+		})
+	if err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	failure := errors.New("failed")
+	if err := metricSystem.TimeCtx(context.Background(), "rpc",
+		func(ctx context.Context) error {
+			return failure
+		}); err != failure {
+		t.Errorf("expected the error of the timed function, got %v", err)
+	}
+
+	histograms := metricSystem.collectRawMetrics().Histograms
+	if len(histograms["rpc_success"]) != 1 || len(histograms["rpc_error"]) != 1 {
+		t.Errorf("expected one success and one error, got %v", histograms)
+	}
+	if _, present := histograms["rpc"]; present {
+		t.Error("expected no histogram under the bare name")
+	}
+	if _, ok := TimerFromContext(context.Background()); ok {
+		t.Error("expected no timer in a plain context")
+	}
+}
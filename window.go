@@ -0,0 +1,158 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Tyler Neely (t@jujit.su)
+
+package loghisto
+
+import (
+	"fmt"
+	"time"
+)
+
+// slidingWindow is a ring of the bucket counts of a histogram in its most
+// recent intervals.  Entries are never modified once added, so snapshots
+// may share them.
+type slidingWindow struct {
+	ring []map[int32]uint64
+	// next is the position in ring that will be overwritten next.
+	next int
+}
+
+// windowSnapshot is the state of a sliding window at the end of an
+// interval, from oldest to newest interval.
+type windowSnapshot struct {
+	mapping   BucketMapping
+	intervals []map[int32]uint64
+}
+
+// SpecifySlidingWindow exports percentiles of the named histogram over a
+// sliding window, such as the last 5 minutes, as
+// <name>_window_<percentile> along with <name>_window_count.  The window
+// advances at every interval, and is rounded up to a whole number of
+// intervals.  Only histograms that use a BucketMapping are supported.
+func (ms *MetricSystem) SpecifySlidingWindow(name string,
+	window time.Duration) {
+	ms.windowsMu.Lock()
+	ms.windows[name] = &slidingWindow{
+		ring: make([]map[int32]uint64, ms.windowIntervals(window)),
+	}
+	ms.windowsMu.Unlock()
+}
+
+// ordered returns the intervals of the window from oldest to newest,
+// skipping the oldest skip intervals.
+func (w *slidingWindow) ordered(skip int) []map[int32]uint64 {
+	intervals := make([]map[int32]uint64, 0, len(w.ring))
+	for i := skip; i < len(w.ring); i++ {
+		if counts := w.ring[(w.next+i)%len(w.ring)]; counts != nil {
+			intervals = append(intervals, counts)
+		}
+	}
+	return intervals
+}
+
+// advanceWindows adds the histograms collected in an interval to their
+// sliding windows, and returns a snapshot of every window.
+func (ms *MetricSystem) advanceWindows(
+	histograms map[string]map[int32]*uint64) map[string]windowSnapshot {
+	ms.windowsMu.Lock()
+	defer ms.windowsMu.Unlock()
+	if len(ms.windows) == 0 {
+		return nil
+	}
+	settings := ms.loadHistogramSettings()
+	snapshots := make(map[string]windowSnapshot, len(ms.windows))
+	for name, w := range ms.windows {
+		counts := make(map[int32]uint64, len(histograms[name]))
+		for key, count := range histograms[name] {
+			counts[key] = *count
+		}
+		w.ring[w.next] = counts
+		w.next = (w.next + 1) % len(w.ring)
+		snapshots[name] = windowSnapshot{
+			mapping:   settings.mapping(name),
+			intervals: w.ordered(0),
+		}
+	}
+	return snapshots
+}
+
+// merge returns a BucketHistogram of every value in the snapshot.
+func (snapshot windowSnapshot) merge() *BucketHistogram {
+	merged := NewBucketHistogram(snapshot.mapping)
+	for _, counts := range snapshot.intervals {
+		for key, count := range counts {
+			merged.counts[key] += count
+			merged.count += count
+			merged.sum += snapshot.mapping.Value(key) * float64(count)
+		}
+	}
+	return merged
+}
+
+// processWindow calculates the <name>_window_ outputs of a sliding window.
+func (ms *MetricSystem) processWindow(name string,
+	snapshot windowSnapshot) map[string]float64 {
+	output := make(map[string]float64)
+	merged := snapshot.merge()
+	windowName := fmt.Sprintf("%s_window", name)
+	output[fmt.Sprintf("%s_count", windowName)] = float64(merged.count)
+	if merged.count == 0 {
+		return output
+	}
+	proportions := make(proportionArray, 0, len(merged.counts))
+	for key, count := range merged.counts {
+		proportions = append(proportions, proportion{
+			Value: snapshot.mapping.Value(key),
+			Count: count,
+			Key:   key,
+		})
+	}
+	ms.addPercentiles(windowName, merged.count, proportions,
+		snapshot.mapping, output)
+	return output
+}
+
+// WindowSnapshot returns the values of the named sliding window as a
+// BucketHistogram, whose Quantiles may be read at any time rather than
+// once per interval.  It includes the values recorded since the last
+// interval in place of the oldest interval of the window.
+func (ms *MetricSystem) WindowSnapshot(name string) (*BucketHistogram,
+	error) {
+	ms.windowsMu.Lock()
+	w, present := ms.windows[name]
+	var intervals []map[int32]uint64
+	if present {
+		intervals = w.ordered(1)
+	}
+	ms.windowsMu.Unlock()
+	if !present {
+		return nil, fmt.Errorf("no sliding window is specified for %s", name)
+	}
+
+	current := ms.shards.peek(name)
+	ms.handlesMu.Lock()
+	if h, present := ms.histogramHandles[name]; present {
+		h.peek(current)
+	}
+	ms.handlesMu.Unlock()
+
+	snapshot := windowSnapshot{
+		mapping:   ms.loadHistogramSettings().mapping(name),
+		intervals: append(intervals, current),
+	}
+	return snapshot.merge(), nil
+}
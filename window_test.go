@@ -0,0 +1,73 @@
+package loghisto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	metricSystem.SpecifySlidingWindow("latency", 2500*time.Millisecond)
+
+	// the window is rounded up to 3 intervals
+	values := []float64{10, 100, 1000, 10000}
+	var metrics map[string]float64
+	for i, value := range values {
+		metricSystem.Histogram("latency", value)
+		metricSystem.Histogram("latency", value)
+		metrics = metricSystem.processMetrics(
+			metricSystem.collectRawMetrics()).Metrics
+		expectedCount := float64(2 * (i + 1))
+		if i >= 3 {
+			expectedCount = 6
+		}
+		if metrics["latency_window_count"] != expectedCount {
+			t.Errorf("expected a window count of %f after interval %d, got %f",
+				expectedCount, i, metrics["latency_window_count"])
+		}
+	}
+	if v := metrics["latency_window_min"]; v < 99 || v > 101 {
+		t.Errorf("expected the first interval to leave the window, got a "+
+			"minimum of %f", v)
+	}
+	if v := metrics["latency_window_max"]; v < 9900 {
+		t.Errorf("expected a window maximum near 10000, got %f", v)
+	}
+
+	// an interval without values keeps reporting the window
+	metrics = metricSystem.processMetrics(
+		metricSystem.collectRawMetrics()).Metrics
+	if metrics["latency_window_count"] != 4 {
+		t.Errorf("expected a window count of 4, got %f",
+			metrics["latency_window_count"])
+	}
+}
+
+func TestWindowSnapshot(t *testing.T) {
+	metricSystem := NewMetricSystem(time.Second, false)
+	if _, err := metricSystem.WindowSnapshot("latency"); err == nil {
+		t.Error("expected an error for a histogram without a window")
+	}
+
+	metricSystem.SpecifySlidingWindow("latency", 2*time.Second)
+	metricSystem.Histogram("latency", 1)
+	metricSystem.collectRawMetrics()
+	metricSystem.Histogram("latency", 10)
+	metricSystem.collectRawMetrics()
+
+	// values recorded since the last interval replace the oldest interval
+	metricSystem.Histogram("latency", 100)
+	metricSystem.NewHistogramHandle("latency").Record(1000)
+	snapshot, err := metricSystem.WindowSnapshot("latency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Count() != 3 {
+		t.Errorf("expected 3 values in the snapshot, got %d", snapshot.Count())
+	}
+	quantiles := snapshot.Quantiles([]float64{0, 1})
+	if quantiles[0] < 9.9 || quantiles[0] > 10.1 || quantiles[1] < 990 {
+		t.Errorf("expected the snapshot to range from 10 to 1000, got %v",
+			quantiles)
+	}
+}